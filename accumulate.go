@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// An accumulator collects the batches of several polls, so they can be posted
+// as a single batch once per -batch-interval.
+type accumulator struct {
+	start    time.Time
+	polls    int
+	last     batch
+	gauges   map[string][]float64
+	counters map[string][]int64
+}
+
+func newAccumulator(now time.Time) *accumulator {
+	return &accumulator{
+		start:    now,
+		gauges:   make(map[string][]float64),
+		counters: make(map[string][]int64),
+	}
+}
+
+// add records a poll's batch.
+func (a *accumulator) add(b batch) {
+	a.polls++
+	a.last = b
+	for name, g := range b.Gauges {
+		a.gauges[name] = append(a.gauges[name], g.Value)
+	}
+	for name, c := range b.Counters {
+		a.counters[name] = append(a.counters[name], c.Value)
+	}
+}
+
+// flush returns a batch of the aggregated samples. The source, tags, and
+// measurement time are those of the last poll.
+func (a *accumulator) flush(gaugeAgg, counterAgg string) batch {
+	b := a.last
+	b.Gauges = make(map[string]gauge, len(a.gauges))
+	b.Counters = make(map[string]counter, len(a.counters))
+
+	for name, samples := range a.gauges {
+		g := gauge{Value: aggregateGauge(gaugeAgg, samples)}
+		if gaugeAgg == "summary" {
+			g.summary = summarize(samples)
+		}
+		b.Gauges[name] = g
+	}
+
+	for name, samples := range a.counters {
+		var v int64
+		switch counterAgg {
+		case "sum":
+			for _, s := range samples {
+				v += s
+			}
+		default:
+			v = samples[len(samples)-1]
+		}
+		b.Counters[name] = counter{Value: v}
+	}
+
+	return b
+}
+
+func aggregateGauge(agg string, samples []float64) float64 {
+	v := samples[0]
+	for _, s := range samples[1:] {
+		switch agg {
+		case "avg", "summary":
+			v += s
+		case "min":
+			if s < v {
+				v = s
+			}
+		case "max":
+			if s > v {
+				v = s
+			}
+		case "last":
+			v = s
+		}
+	}
+
+	if agg == "avg" || agg == "summary" {
+		v /= float64(len(samples))
+	}
+	return v
+}
+
+// A summary is the fields of one of Librato's aggregate gauges, which describe
+// a set of samples rather than a single value.
+type summary struct {
+	Count      int     `json:"count"`
+	Sum        float64 `json:"sum"`
+	Min        float64 `json:"min"`
+	Max        float64 `json:"max"`
+	SumSquares float64 `json:"sum_squares"`
+}
+
+func summarize(samples []float64) *summary {
+	s := &summary{Count: len(samples), Min: samples[0], Max: samples[0]}
+	for _, v := range samples {
+		s.Sum += v
+		s.SumSquares += v * v
+		if v < s.Min {
+			s.Min = v
+		}
+		if v > s.Max {
+			s.Max = v
+		}
+	}
+	return s
+}
+
+// accumulate adds the batch to the target's accumulator. It returns the
+// aggregated batch and true if it's time to post it.
+func (c *config) accumulate(key string, b batch, now time.Time) (batch, bool) {
+	if c.accumulators == nil {
+		c.accumulators = make(map[string]*accumulator)
+	}
+
+	a, ok := c.accumulators[key]
+	if !ok {
+		a = newAccumulator(now)
+		c.accumulators[key] = a
+	}
+	a.add(b)
+
+	if now.Sub(a.start) < c.batchInterval {
+		log.Printf("  accumulated %d polls, posting in %s", a.polls, c.batchInterval-now.Sub(a.start))
+		return b, false
+	}
+
+	delete(c.accumulators, key)
+	return a.flush(c.gaugeAggregate, c.counterAggregate), true
+}
+
+// validAggregate returns an error if the aggregate isn't one of the allowed.
+func validAggregate(agg string, allowed ...string) error {
+	for _, a := range allowed {
+		if agg == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown aggregate %q", agg)
+}
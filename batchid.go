@@ -0,0 +1,35 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"log"
+)
+
+// newBatchID returns a random (version 4) UUID.
+func newBatchID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// identify gives the batch a new ID, which is logged, sent as the
+// -batch-id-header, and in tagged mode added as the -batch-id-tag, so a
+// collection's log lines can be matched with its measurements.
+func (c *config) identify(b *batch) {
+	b.ID = newBatchID()
+	log.Printf("  batch id %s", b.ID)
+
+	if c.tagged && c.batchIDTag != "" {
+		tags := make(map[string]string, len(b.Tags)+1)
+		for k, v := range b.Tags {
+			tags[k] = v
+		}
+		tags[c.batchIDTag] = b.ID
+		b.Tags = tags
+	}
+}
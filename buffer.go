@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A buffer keeps batches which failed to post on disk, so they can be replayed
+// once Librato recovers. Batches are stamped with their measurement time before
+// they're buffered, so they land where they belong when they're replayed.
+type buffer struct {
+	dir    string
+	max    int
+	maxAge time.Duration
+}
+
+// save writes the batch to the buffer, pruning it if it's grown too large.
+func (b *buffer) save(batch batch, now time.Time) {
+	if batch.MeasureTime == 0 {
+		batch.MeasureTime = now.Unix()
+	}
+
+	j, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("unable to buffer batch: %v", err)
+		return
+	}
+
+	name, err := b.write(j, now)
+	if err != nil {
+		log.Printf("unable to buffer batch: %v", err)
+		return
+	}
+	log.Printf("buffered batch as %s", name)
+}
+
+// saveFailed buffers the chunks of the batch which failed to post, or the whole
+// batch if it failed before any chunk was posted, so chunks Librato has already
+// accepted aren't posted again.
+func (b *buffer) saveFailed(batch batch, err error, now time.Time) {
+	ce, ok := err.(*chunkError)
+	if !ok {
+		b.save(batch, now)
+		return
+	}
+	for _, c := range ce.chunks {
+		b.save(c, now)
+	}
+}
+
+// write writes a file named for the time to the directory, pruning it if it's
+// grown too large. -post-dump-dir uses it to keep posted bodies, too. The file
+// is written under a temporary name and renamed into place, so replay never
+// reads a half-written one.
+func (b *buffer) write(j []byte, now time.Time) (string, error) {
+	for nanos := now.UnixNano(); ; nanos++ {
+		name := filepath.Join(b.dir, fmt.Sprintf("%019d.json", nanos))
+		if _, err := os.Stat(name); err == nil {
+			continue
+		}
+
+		tmp := name + ".tmp"
+		f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) {
+			// another chunk written at the same time has this name
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		_, err = f.Write(j)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(tmp, name)
+		}
+		if err != nil {
+			_ = os.Remove(tmp)
+			return "", err
+		}
+
+		b.prune(now)
+		return name, nil
+	}
+}
+
+// files returns the buffered batches' file names, oldest first.
+func (b *buffer) files() []string {
+	names, err := filepath.Glob(filepath.Join(b.dir, "*.json"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(names)
+	return names
+}
+
+// prune removes batches which are older than the maximum age, then the oldest
+// batches beyond the maximum count.
+func (b *buffer) prune(now time.Time) {
+	names := b.files()
+
+	var kept []string
+	for _, name := range names {
+		if b.expired(name, now) {
+			log.Printf("discarding expired batch %s", name)
+			_ = os.Remove(name)
+			continue
+		}
+		kept = append(kept, name)
+	}
+
+	for b.max > 0 && len(kept) > b.max {
+		log.Printf("buffer full, discarding batch %s", kept[0])
+		_ = os.Remove(kept[0])
+		kept = kept[1:]
+	}
+}
+
+func (b *buffer) expired(name string, now time.Time) bool {
+	if b.maxAge == 0 {
+		return false
+	}
+
+	var nanos int64
+	if _, err := fmt.Sscanf(strings.TrimSuffix(filepath.Base(name), ".json"), "%d", &nanos); err != nil {
+		return false
+	}
+	return now.Sub(time.Unix(0, nanos)) > b.maxAge
+}
+
+// A bufferedBatch is a batch read from the buffer, and its file name.
+type bufferedBatch struct {
+	name  string
+	batch batch
+}
+
+// replay posts the buffered batches in order of measurement time, stopping at
+// the first one which fails to post. Batches measured with -time-path may not
+// have been buffered in the order they were measured, so they're sorted rather
+// than replayed in the order they were saved.
+func (b *buffer) replay(cfg *config) {
+	b.prune(time.Now())
+
+	var batches []bufferedBatch
+	for _, name := range b.files() {
+		j, err := ioutil.ReadFile(name)
+		if err != nil {
+			log.Printf("unable to read buffered batch: %v", err)
+			continue
+		}
+
+		var batch batch
+		if err := json.Unmarshal(j, &batch); err != nil {
+			log.Printf("discarding corrupt batch %s: %v", name, err)
+			_ = os.Remove(name)
+			continue
+		}
+		batches = append(batches, bufferedBatch{name: name, batch: batch})
+	}
+
+	sort.SliceStable(batches, func(i, j int) bool {
+		return batches[i].batch.MeasureTime < batches[j].batch.MeasureTime
+	})
+
+	for _, e := range batches {
+		if err := try(func() { postBatch(context.Background(), e.batch, cfg) }); err != nil {
+			log.Printf("unable to replay batch %s: %v", e.name, err)
+
+			// if some of its chunks were posted, only the rest are kept
+			if _, ok := err.(*chunkError); ok {
+				b.saveFailed(e.batch, err, time.Now())
+				_ = os.Remove(e.name)
+			}
+			return
+		}
+
+		log.Printf("replayed batch %s", e.name)
+		_ = os.Remove(e.name)
+	}
+}
+
+// run replays the buffer periodically.
+func (b *buffer) run(cfg *config, interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		b.replay(cfg)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReplayOrder(t *testing.T) {
+	// a batch big enough to be posted in two chunks
+	big := batch{Gauges: make(map[string]gauge), Source: "web", MeasureTime: 200}
+	for i := 0; i < maxMeasurements+1; i++ {
+		big.Gauges[fmt.Sprintf("g%03d", i)] = gauge{Value: float64(i)}
+	}
+
+	tests := []struct {
+		name    string
+		batches []batch
+		want    []string
+	}{
+		{
+			name: "saved out of order",
+			batches: []batch{
+				{Gauges: map[string]gauge{"a": {Value: 3}}, Source: "web", MeasureTime: 300},
+				{Gauges: map[string]gauge{"a": {Value: 1}}, Source: "web", MeasureTime: 100},
+				{Gauges: map[string]gauge{"a": {Value: 2}}, Source: "web", MeasureTime: 200},
+			},
+			want: []string{"100 a", "200 a", "300 a"},
+		},
+		{
+			name: "chunked",
+			batches: []batch{
+				{Gauges: map[string]gauge{"a": {Value: 3}}, Source: "web", MeasureTime: 300},
+				big,
+				{Gauges: map[string]gauge{"a": {Value: 1}}, Source: "web", MeasureTime: 100},
+			},
+			want: []string{"100 a", "200 g000", "200 g300", "300 a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var posted []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var b batch
+				if err := json.Unmarshal(body, &b); err != nil {
+					t.Errorf("unable to parse posted batch: %v", err)
+				}
+
+				mu.Lock()
+				posted = append(posted, fmt.Sprintf("%d %s", b.MeasureTime, b.gaugeNames()[0]))
+				mu.Unlock()
+			}))
+			defer srv.Close()
+
+			buf := &buffer{dir: t.TempDir()}
+			now := time.Now()
+			for i, b := range tt.batches {
+				buf.save(b, now.Add(time.Duration(i)*time.Second))
+			}
+
+			buf.replay(&config{
+				postMethod:      "POST",
+				postRetries:     1,
+				retryBackoff:    time.Millisecond,
+				postConcurrency: 1,
+				poster:          http.DefaultClient,
+				sink:            libratoSink{endpoint: srv.URL},
+			})
+
+			if fmt.Sprint(posted) != fmt.Sprint(tt.want) {
+				t.Errorf("replayed %v, want %v", posted, tt.want)
+			}
+			if files := buf.files(); len(files) != 0 {
+				t.Errorf("%d batches left in the buffer after replay", len(files))
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// A configFile is a file of -gauge, -counter, and -tag flags, one per line
+// (e.g. "gauge heap.used=heap"), which are added to the command line's. Blank
+// lines and lines starting with '#' are skipped. It's re-read on SIGHUP, so
+// metrics can be changed without a restart losing the collector's state.
+type configFile struct {
+	path string
+
+	// the command line's, which the file's are added to
+	gauges, counters metricList
+	tags             tagMap
+}
+
+// load reads the file, returning the command line's gauges, counters, and tags
+// with its own. The command line's tags override the file's.
+func (f *configFile) load() (gauges, counters metricList, tags tagMap, err error) {
+	r, err := os.Open(f.path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer r.Close()
+
+	gauges = append(metricList(nil), f.gauges...)
+	counters = append(metricList(nil), f.counters...)
+	tags = make(tagMap)
+
+	fs := flag.NewFlagSet(f.path, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	fs.Var(&gauges, "gauge", "")
+	fs.Var(&counters, "counter", "")
+	fs.Var(&tags, "tag", "")
+
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		name, value := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			name, value = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		if err := fs.Set(strings.TrimLeft(name, "-"), value); err != nil {
+			return nil, nil, nil, fmt.Errorf("%s:%d: %v", f.path, n, err)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	for k, v := range f.tags {
+		tags[k] = v
+	}
+	return gauges, counters, tags, nil
+}
+
+// reload re-reads the -config file, replacing the gauges, counters, and tags.
+// If it's invalid, the current ones are kept. The state of each metric, like
+// the last value posted, is kept by name, so it carries over to any metric
+// which is still collected.
+func (c *config) reload(f *configFile, engine string) error {
+	gauges, counters, tags, err := f.load()
+	if err != nil {
+		return err
+	}
+	if engine == "rfc9535" {
+		if _, err := parseJSONPaths(gauges, counters, c.strlens); err != nil {
+			return err
+		}
+	}
+
+	c.gauges, c.counters, c.tags = gauges, counters, tags
+	if c.countersAsGauges {
+		c.gauges = append(c.gauges, c.counters...)
+		c.counters = nil
+	}
+	return c.preparePaths(engine)
+}
+
+// preparePaths prepares the metrics' paths for the JSONPath engine: parsing
+// them as RFC 9535 JSONPaths, or finding the dotted ones which need XML
+// selectors or have the |json modifier.
+func (c *config) preparePaths(engine string) error {
+	switch engine {
+	case "dotted":
+		if c.format == "xml" {
+			xmlSelectors(c.gauges, c.counters, c.strlens)
+		}
+
+		paths := []string{c.timePath}
+		for _, l := range []metricList{c.gauges, c.counters, c.strlens, c.edgeCounters} {
+			for _, m := range l {
+				paths = append(paths, m.path)
+			}
+		}
+		// -gauge-each reads its values and names from each of the array's
+		// elements, which decodeEmbedded goes into
+		for _, m := range c.gaugeEach {
+			paths = append(paths, m.array, m.array+"."+m.value, m.array+"."+m.name)
+		}
+		for _, m := range c.matchCounts {
+			paths = append(paths, m.array)
+		}
+		for _, m := range c.sums {
+			paths = append(paths, m.object)
+		}
+		for _, cond := range c.conditions {
+			paths = append(paths, cond.path)
+		}
+		for _, path := range c.tagPaths {
+			paths = append(paths, path)
+		}
+		c.embedded = embeddedPaths(paths...)
+	case "rfc9535":
+		paths, err := parseJSONPaths(c.gauges, c.counters, c.strlens)
+		if err != nil {
+			return err
+		}
+		c.jsonPaths = paths
+	default:
+		return fmt.Errorf("unknown JSONPath engine: %s", engine)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// cookieList is a set of cookies given as name=value, sent with every fetch.
+type cookieList []*http.Cookie
+
+func (l *cookieList) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+	*l = append(*l, &http.Cookie{Name: v[:i], Value: v[i+1:]})
+	return nil
+}
+
+func (l *cookieList) String() string {
+	var s []string
+	for _, c := range *l {
+		s = append(s, c.Name+"="+c.Value)
+	}
+	return strings.Join(s, ",")
+}
+
+// login fetches the -login-url once, so that the fetch client's cookie jar
+// holds whatever session cookies it sets for later fetches. It may take as long
+// as a collection.
+func login(cfg *config, loginURL string) error {
+	ctx := context.Background()
+	if cfg.collectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.collectTimeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", loginURL, nil)
+	if err != nil {
+		return err
+	}
+	for _, c := range cfg.cookies {
+		req.AddCookie(c)
+	}
+
+	resp, err := cfg.fetcher.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	// the session cookies are as good as credentials, so they're redacted
+	// before anything can log them, whether or not the login worked
+	for _, c := range resp.Cookies() {
+		redactSecrets(c.Value)
+	}
+	if cfg.fetcher.Jar != nil {
+		for _, c := range cfg.fetcher.Jar.Cookies(req.URL) {
+			redactSecrets(c.Value)
+		}
+	}
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("received a %s response", resp.Status)
+	}
+	log.Printf("logged in at %s", loginURL)
+	return nil
+}
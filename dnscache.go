@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// A dnsCache remembers the addresses hosts resolve to for a TTL, so that
+// frequent fetches from the same host don't each need a lookup.
+type dnsCache struct {
+	sync.Mutex
+	ttl     time.Duration
+	dialer  *net.Dialer
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+func newDNSCache(ttl time.Duration, dialer *net.Dialer) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		dialer:  dialer,
+		entries: make(map[string]dnsEntry),
+	}
+}
+
+// lookup returns the host's addresses, from the cache if they haven't expired.
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.Lock()
+	e, ok := c.entries[host]
+	c.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.addrs, nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	c.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.Unlock()
+	return addrs, nil
+}
+
+// dial connects to the first of the host's cached addresses which accepts the
+// connection. A host which fails to connect at all is dropped from the cache,
+// in case its addresses have changed.
+func (c *dnsCache) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return c.dialer.DialContext(ctx, network, addr)
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range addrs {
+		var conn net.Conn
+		conn, err = c.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+
+	c.Lock()
+	delete(c.entries, host)
+	c.Unlock()
+	return nil, err
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// An eachMetric reads a value from every object in an array, naming each
+// measurement after another of the object's fields. For example,
+// "pools[].size name=name" posts pools.cacheA.size for the element
+// {"name":"cacheA","size":10}. In tagged mode, it may also tag each
+// measurement with the name, so "pools[].size name=name tag=pool" tags that
+// measurement with pool=cacheA.
+type eachMetric struct {
+	array string
+	value string
+	name  string
+	tag   string
+}
+
+// parseEachMetric parses a metric of the form array[].value name=path
+// [tag=key].
+func parseEachMetric(s string) (eachMetric, error) {
+	var m eachMetric
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return m, fmt.Errorf("empty metric")
+	}
+
+	i := strings.Index(fields[0], "[].")
+	if i <= 0 {
+		return m, fmt.Errorf("expected array[].value in %q", s)
+	}
+	m.array, m.value = fields[0][:i], fields[0][i+3:]
+
+	for _, f := range fields[1:] {
+		switch {
+		case strings.HasPrefix(f, "name="):
+			m.name = strings.TrimPrefix(f, "name=")
+		case strings.HasPrefix(f, "tag="):
+			m.tag = strings.TrimPrefix(f, "tag=")
+		default:
+			return m, fmt.Errorf("unknown option %q in %q", f, s)
+		}
+	}
+
+	if m.value == "" || m.name == "" {
+		return m, fmt.Errorf("expected array[].value name=path in %q", s)
+	}
+	return m, nil
+}
+
+// gauges adds a gauge to the batch for every element of the array.
+func (m eachMetric) gauges(jq *jsonq.JsonQuery, b *batch, cfg *config, t *tally) {
+	elems, err := jq.Array(strings.Split(m.array, ".")...)
+	if err != nil {
+		t.fail(fmt.Errorf("%s: %v", m.array, err))
+		return
+	}
+
+	for i, e := range elems {
+		obj, ok := e.(map[string]interface{})
+		if !ok {
+			t.fail(fmt.Errorf("%s.%d: expected an object, got %v", m.array, i, e))
+			continue
+		}
+		ejq := jsonq.NewQuery(obj)
+
+		n, err := ejq.Interface(strings.Split(m.name, ".")...)
+		if err != nil {
+			t.fail(fmt.Errorf("%s.%d.%s: %v", m.array, i, m.name, err))
+			continue
+		}
+
+		vm := metric{path: m.value}
+		v, err := cfg.gaugeValue(ejq, vm)
+		if err != nil {
+			t.fail(fmt.Errorf("%s.%d.%s: %v", m.array, i, m.value, err))
+			continue
+		}
+
+		keys := append(strings.Split(m.array, "."), fmt.Sprint(n))
+		keys = append(keys, vm.keys()...)
+		name := cfg.suffixGauge(cfg.qualify(strings.Join(keys, cfg.separator)))
+		log.Printf("  %s=%v", name, v)
+		b.Gauges[name] = gauge{Value: v}
+		if cfg.tagged && m.tag != "" {
+			b.tagMetric(name, m.tag, fmt.Sprint(n))
+		}
+	}
+}
+
+type eachMetricList []eachMetric
+
+func (l *eachMetricList) Set(v string) error {
+	m, err := parseEachMetric(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, m)
+	return nil
+}
+
+func (l *eachMetricList) String() string {
+	s := make([]string, len(*l))
+	for i, m := range *l {
+		s[i] = m.array + "[]." + m.value
+	}
+	return strings.Join(s, ",")
+}
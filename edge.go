@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// An edge is the state of an -edge-counter: the boolean's last value, and how
+// many times it's gone from false to true.
+type edge struct {
+	last  bool
+	count int64
+}
+
+// addEdges adds a counter for each -edge-counter of the number of times its
+// boolean has risen from false to true since the collector started. The first
+// value seen is only a starting point, and never counts as an edge.
+func (c *config) addEdges(key string, jq *jsonq.JsonQuery, b *batch, t *tally) {
+	if c.edges == nil {
+		c.edges = make(map[string]*edge)
+	}
+
+	for _, m := range c.edgeCounters {
+		v, err := boolValue(jq, m)
+		if err != nil {
+			if !m.missing(jq) {
+				t.fail(fmt.Errorf("%s: %v", m.path, err))
+				continue
+			}
+			v = m.fallback() != 0
+		}
+
+		name := c.suffixCounter(c.metricName(m))
+		e, ok := c.edges[key+"/"+name]
+		if !ok {
+			e = &edge{last: v}
+			c.edges[key+"/"+name] = e
+		} else if v && !e.last {
+			e.count++
+		}
+		e.last = v
+
+		log.Printf("  %s=%v", name, e.count)
+		if c.countersAsGauges {
+			b.Gauges[name] = gauge{Value: float64(e.count)}
+		} else {
+			b.Counters[name] = counter{Value: e.count}
+		}
+	}
+}
+
+// boolValue returns a boolean, or a number which is true if it's non-zero.
+func boolValue(jq *jsonq.JsonQuery, m metric) (bool, error) {
+	v, err := jq.Interface(m.keys()...)
+	if err != nil {
+		return false, err
+	}
+
+	switch v := v.(type) {
+	case bool:
+		return v, nil
+	case json.Number:
+		f, err := v.Float64()
+		return f != 0, err
+	case float64:
+		return v != 0, nil
+	}
+	return false, fmt.Errorf("expected a boolean, got %v", v)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// jsonModifier marks a path component whose value is a string of JSON, which
+// is decoded before the path goes on into it (e.g. details|json.active).
+const jsonModifier = "|json"
+
+// embeddedPaths returns each distinct path, up to and including a component
+// with the |json modifier, in the given dotted paths.
+func embeddedPaths(paths ...string) [][]string {
+	var embedded [][]string
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		keys := strings.Split(p, ".")
+		for i, k := range keys {
+			prefix := strings.Join(keys[:i+1], ".")
+			if strings.HasSuffix(k, jsonModifier) && !seen[prefix] {
+				seen[prefix] = true
+				embedded = append(embedded, keys[:i+1])
+			}
+		}
+	}
+	return embedded
+}
+
+// decodeEmbedded decodes the JSON strings at the given paths, adding them to
+// the document alongside the strings, under their names with the |json
+// modifier. A path goes into every element of an array it meets, unless its
+// next component is an index into it, so it reaches the strings in lists of
+// objects too. A value which isn't a string of valid JSON is left out, so
+// paths into it are missing like any other.
+func decodeEmbedded(doc map[string]interface{}, paths [][]string) {
+	for _, keys := range paths {
+		decodeAt(doc, keys)
+	}
+}
+
+// decodeAt decodes the JSON string at the path from v.
+func decodeAt(v interface{}, keys []string) {
+	switch v := v.(type) {
+	case []interface{}:
+		if i, err := strconv.Atoi(keys[0]); err == nil {
+			if i >= 0 && i < len(v) && len(keys) > 1 {
+				decodeAt(v[i], keys[1:])
+			}
+			return
+		}
+		for _, e := range v {
+			decodeAt(e, keys)
+		}
+	case map[string]interface{}:
+		if len(keys) > 1 {
+			decodeAt(v[keys[0]], keys[1:])
+			return
+		}
+
+		s, ok := v[strings.TrimSuffix(keys[0], jsonModifier)].(string)
+		if !ok {
+			return
+		}
+
+		var d interface{}
+		dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+		dec.UseNumber()
+		if err := dec.Decode(&d); err == nil {
+			v[keys[0]] = d
+		}
+	}
+}
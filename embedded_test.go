@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/jsonq"
+)
+
+func TestDecodeEmbedded(t *testing.T) {
+	tests := []struct {
+		name   string
+		doc    string
+		decode string
+		path   string
+		want   interface{}
+	}{
+		{"object", `{"details": "{\"active\": 5}"}`, "details|json.active", "details|json.active", "5"},
+		{"nested", `{"a": "{\"b\": \"{\\\"c\\\": 1}\"}"}`, "a|json.b|json.c", "a|json.b|json.c", "1"},
+		{"array index", `{"pools": [{"stats": "{\"size\": 1}"}, {"stats": "{\"size\": 2}"}]}`, "pools.1.stats|json.size", "pools.1.stats|json.size", "2"},
+		{"not the other elements", `{"pools": [{"stats": "{\"size\": 1}"}, {"stats": "{\"size\": 2}"}]}`, "pools.1.stats|json.size", "pools.0.stats|json.size", nil},
+		// an unindexed path, like -gauge-each's, decodes every element
+		{"every element", `{"pools": [{"stats": "{\"size\": 1}"}, {"stats": "{\"size\": 2}"}]}`, "pools.stats|json.size", "pools.0.stats|json.size", "1"},
+		{"invalid JSON", `{"details": "{active"}`, "details|json.active", "details|json.active", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var doc map[string]interface{}
+			d := json.NewDecoder(strings.NewReader(tt.doc))
+			d.UseNumber()
+			if err := d.Decode(&doc); err != nil {
+				t.Fatal(err)
+			}
+
+			decodeEmbedded(doc, embeddedPaths(tt.decode))
+
+			got, err := jsonq.NewQuery(doc).Interface(strings.Split(tt.path, ".")...)
+			if tt.want == nil {
+				if err == nil {
+					t.Errorf("%s = %v, want it missing", tt.path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", tt.path, err)
+			}
+			if fmt.Sprint(got) != tt.want {
+				t.Errorf("%s = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmbeddedPathKinds(t *testing.T) {
+	each, err := parseEachMetric("pools[].stats|json.size name=meta|json.name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{gaugeEach: eachMetricList{each}, tagPaths: tagMap{"zone": "host|json.zone"}}
+	if err := cfg.preparePaths("dotted"); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, len(cfg.embedded))
+	for i, keys := range cfg.embedded {
+		got[i] = strings.Join(keys, ".")
+	}
+	want := []string{"pools.stats|json", "pools.meta|json", "host|json"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("embedded paths = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decodeBody returns a reader for the response's body, decoded according to
+// its Content-Encoding.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	enc := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding")))
+	switch enc {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(resp.Body)
+	case "deflate":
+		return inflate(resp.Body)
+	case "br":
+		return brotli.NewReader(resp.Body), nil
+	}
+	return nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+}
+
+// inflate returns a reader for a deflate-encoded body. HTTP's deflate is
+// zlib-wrapped, but plenty of servers send raw deflate data instead, so the
+// zlib header is checked for first.
+func inflate(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	h, err := br.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	if h[0]&0x0f == 8 && (uint16(h[0])<<8|uint16(h[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// extraFields are -extra-field's fields, which are added to every measurement
+// posted, for Librato API fields the collector doesn't know about yet.
+var extraFields extraFieldList
+
+// An extraFieldList is a set of fields given as key=value, where the value is
+// JSON.
+type extraFieldList map[string]json.RawMessage
+
+func (l *extraFieldList) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+	if !json.Valid([]byte(v[i+1:])) {
+		return fmt.Errorf("the value of %s isn't valid JSON: %s", v[:i], v[i+1:])
+	}
+
+	if *l == nil {
+		*l = make(extraFieldList)
+	}
+	(*l)[v[:i]] = json.RawMessage(v[i+1:])
+	return nil
+}
+
+func (l *extraFieldList) String() string {
+	s := make([]string, 0, len(*l))
+	for k, v := range *l {
+		s = append(s, k+"="+string(v))
+	}
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// withExtraFields adds the extra fields to a measurement's JSON object. The
+// measurement's own fields, like its value, are never replaced.
+func withExtraFields(j []byte, err error) ([]byte, error) {
+	if err != nil || len(extraFields) == 0 {
+		return j, err
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(j, &fields); err != nil {
+		return nil, err
+	}
+	for k, v := range extraFields {
+		if _, ok := fields[k]; !ok {
+			fields[k] = v
+		}
+	}
+	return json.Marshal(fields)
+}
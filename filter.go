@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log"
+	"path"
+	"strings"
+)
+
+// globList is a set of glob patterns, as matched by path.Match.
+type globList []string
+
+func (l *globList) Set(v string) error {
+	if _, err := path.Match(v, ""); err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
+
+func (l *globList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// matches returns true if any of the patterns matches the name.
+func (l globList) matches(name string) bool {
+	for _, p := range l {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed returns true if the metric name passes -allow and -deny. A name
+// which matches both is denied.
+func (c *config) allowed(name string) bool {
+	if c.deny.matches(name) {
+		return false
+	}
+	return len(c.allow) == 0 || c.allow.matches(name)
+}
+
+// filter removes any measurements which -allow and -deny don't allow.
+func (c *config) filter(b *batch) {
+	for name := range b.Gauges {
+		if !c.allowed(name) {
+			log.Printf("  %s filtered out", name)
+			delete(b.Gauges, name)
+		}
+	}
+	for name := range b.Counters {
+		if !c.allowed(name) {
+			log.Printf("  %s filtered out", name)
+			delete(b.Counters, name)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// decodeDocument decodes a response body in the given format into the same
+// kind of document JSON decodes into, so paths work the same for every format.
+func decodeDocument(format string, r io.Reader) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+	switch format {
+	case "json":
+		// decode numbers as json.Number so large integers keep their precision
+		dec := json.NewDecoder(r)
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	case "yaml":
+		if err := yaml.NewDecoder(r).Decode(&doc); err != nil {
+			return nil, err
+		}
+	case "toml":
+		if _, err := toml.NewDecoder(r).Decode(&doc); err != nil {
+			return nil, err
+		}
+	case "ndjson":
+		return decodeNDJSON(r)
+	case "xml":
+		return decodeXML(r)
+	case "form":
+		return decodeForm(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return normalize(doc).(map[string]interface{}), nil
+}
+
+// decodeNDJSON decodes newline-delimited JSON into a document whose lines
+// field is an array of every line's value. Blank lines are skipped.
+func decodeNDJSON(r io.Reader) (map[string]interface{}, error) {
+	lines := []interface{}{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var v interface{}
+		dec := json.NewDecoder(strings.NewReader(line))
+		dec.UseNumber()
+		if err := dec.Decode(&v); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		lines = append(lines, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{"lines": lines}, nil
+}
+
+// decodeForm decodes a form-encoded body (a=1&b.c=2) into a document, with
+// dotted keys nested as objects so they're addressed by the same paths. Values
+// which are numbers are decoded as numbers, and the rest are left as strings.
+// A key given more than once is an array of its values. A key which is both a
+// value and an object (a=1&a.b=2) is an error, rather than one or the other
+// winning.
+func decodeForm(r io.Reader) (map[string]interface{}, error) {
+	body, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	values, err := url.ParseQuery(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+
+	// in order, so a key is always set before any under it, and which one
+	// conflicts doesn't change
+	names := make([]string, 0, len(values))
+	for k := range values {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	doc := make(map[string]interface{})
+	for _, k := range names {
+		vs := values[k]
+		parsed := make([]interface{}, len(vs))
+		for i, v := range vs {
+			parsed[i] = v
+			if n, ok := decimal(v); ok {
+				parsed[i] = n
+			}
+		}
+
+		keys := strings.Split(k, ".")
+		parent := doc
+		for i, key := range keys[:len(keys)-1] {
+			v, ok := parent[key]
+			if !ok {
+				v = make(map[string]interface{})
+				parent[key] = v
+			}
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s conflicts with %s", k, strings.Join(keys[:i+1], "."))
+			}
+			parent = m
+		}
+		if len(parsed) == 1 {
+			parent[keys[len(keys)-1]] = parsed[0]
+		} else {
+			parent[keys[len(keys)-1]] = parsed
+		}
+	}
+	return doc, nil
+}
+
+// normalize converts the values decoded from YAML or TOML into their JSON
+// equivalents: string-keyed objects, []interface{} arrays, and json.Number
+// integers.
+func normalize(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = normalize(e)
+		}
+		return v
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []map[string]interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = normalize(e)
+		}
+		return a
+	case []interface{}:
+		for i, e := range v {
+			v[i] = normalize(e)
+		}
+		return v
+	case int:
+		return json.Number(strconv.Itoa(v))
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	}
+	return v
+}
+
+// decimal returns a string as a number if it's a finite decimal, as JSON
+// writes numbers. Go parses more than that, like inf, nan, and hex floats
+// (0x1p3), but encoding/json won't marshal them, which -debug, -report-json,
+// and -passthrough all do.
+func decimal(s string) (json.Number, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) || !json.Valid([]byte(s)) {
+		return "", false
+	}
+	return json.Number(s), true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/jsonq"
+)
+
+func TestDecodeYAML(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		json  string
+		path  string
+		value float64
+	}{
+		{
+			name: "nested objects",
+			yaml: "server:\n  heap:\n    used: 1024\n    max: 4096\n  load: 0.75\n",
+			json: `{"server": {"heap": {"used": 1024, "max": 4096}, "load": 0.75}}`,
+			path: "server.heap.used", value: 1024,
+		},
+		{
+			name: "arrays of objects",
+			yaml: "pools:\n  - name: a\n    size: 3\n  - name: b\n    size: 5\n",
+			json: `{"pools": [{"name": "a", "size": 3}, {"name": "b", "size": 5}]}`,
+			path: "pools.1.size", value: 5,
+		},
+		{
+			name: "non-string keys",
+			yaml: "shards:\n  1: 10\n  2: 20\nenabled: true\n",
+			json: `{"shards": {"1": 10, "2": 20}, "enabled": true}`,
+			// jsonq reads all-digit path segments as array indexes, so the
+			// stringified keys can't be reached by a path; only the
+			// round-trip is checked
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := decodeDocument("yaml", strings.NewReader(tt.yaml))
+			if err != nil {
+				t.Fatalf("decodeDocument(yaml) error = %v", err)
+			}
+			want, err := decodeDocument("json", strings.NewReader(tt.json))
+			if err != nil {
+				t.Fatalf("decodeDocument(json) error = %v", err)
+			}
+
+			// the YAML document round-trips to the same JSON as its equivalent
+			got, err := json.Marshal(doc)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			wantJSON, err := json.Marshal(want)
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if string(got) != string(wantJSON) {
+				t.Errorf("decoded %s, want %s", got, wantJSON)
+			}
+
+			if tt.path == "" {
+				return
+			}
+
+			// and its paths resolve the same way
+			v, err := (&config{}).gaugeValue(jsonq.NewQuery(doc), metric{path: tt.path})
+			if err != nil {
+				t.Fatalf("gaugeValue(%s) error = %v", tt.path, err)
+			}
+			if v != tt.value {
+				t.Errorf("gaugeValue(%s) = %v, want %v", tt.path, v, tt.value)
+			}
+		})
+	}
+}
+
+func TestDecodeFormNumbers(t *testing.T) {
+	tests := []struct {
+		value   string
+		numeric bool
+	}{
+		{"42", true},
+		{"-2.5", true},
+		{"1e3", true},
+		{"inf", false},
+		{"-Infinity", false},
+		{"nan", false},
+		{"0x1p3", false},
+		{"+1", false},
+		{".5", false},
+		{"1e400", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			doc, err := decodeDocument("form", strings.NewReader("v="+url.QueryEscape(tt.value)))
+			if err != nil {
+				t.Fatalf("decodeDocument(form) error = %v", err)
+			}
+
+			_, numeric := doc["v"].(json.Number)
+			if numeric != tt.numeric {
+				t.Errorf("%s decoded as %T, want numeric %v", tt.value, doc["v"], tt.numeric)
+			}
+
+			// whatever it is, it can be logged and reported
+			if _, err := json.Marshal(doc); err != nil {
+				t.Errorf("json.Marshal() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+//go:build grpc
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthCheck is the standard gRPC health checking method, which is answered
+// in protobuf rather than JSON.
+const healthCheck = "/grpc.health.v1.Health/Check"
+
+// fetchGRPC calls a unary gRPC method, given as a grpc:// or grpcs:// URL like
+// grpc://host:port/package.Service/Method, and decodes its response. The
+// method is expected to speak JSON, with -grpc-request as its request, except
+// for the standard health check, whose status is given as both status
+// ("SERVING", ...) and serving (1 or 0). The check's service is the URL's
+// service query parameter.
+func fetchGRPC(ctx context.Context, cfg *config, u *url.URL, result *fetchResult) map[string]interface{} {
+	creds := insecure.NewCredentials()
+	if u.Scheme == "grpcs" {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	conn, err := grpc.Dial(u.Host, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		panic(err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	defer func() {
+		result.latency = time.Since(start)
+	}()
+
+	if u.Path == healthCheck {
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{
+			Service: u.Query().Get("service"),
+		})
+		if err != nil {
+			panic(err)
+		}
+		result.status = 200
+
+		serving := json.Number("0")
+		if resp.Status == healthpb.HealthCheckResponse_SERVING {
+			serving = "1"
+		}
+		return map[string]interface{}{"status": resp.Status.String(), "serving": serving}
+	}
+
+	req := []byte(cfg.grpcRequest)
+	var resp []byte
+	if err := conn.Invoke(ctx, u.Path, &req, &resp, grpc.ForceCodec(rawCodec{})); err != nil {
+		panic(err)
+	}
+	// there's no HTTP status, so a successful call is recorded as a 200
+	result.status = 200
+
+	doc, err := decodeDocument("json", bytes.NewReader(resp))
+	if err != nil {
+		panic(err)
+	}
+	return doc
+}
+
+// rawCodec passes messages through as bytes, with the json content subtype,
+// for services which speak JSON over gRPC.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	return *v.(*[]byte), nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	*v.(*[]byte) = append([]byte(nil), data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "json"
+}
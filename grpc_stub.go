@@ -0,0 +1,14 @@
+//go:build !grpc
+
+package main
+
+import (
+	"context"
+	"net/url"
+)
+
+// fetchGRPC is only available when built with -tags grpc, which keeps the gRPC
+// dependencies out of ordinary builds.
+func fetchGRPC(ctx context.Context, cfg *config, u *url.URL, result *fetchResult) map[string]interface{} {
+	panic("gRPC URLs need a build with -tags grpc")
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hooks tracks the running hooks, so a one-shot run can wait for them.
+var hooks sync.WaitGroup
+
+// runHook runs a shell command in the background, describing a failed
+// collection in its environment. It's best-effort: failing to run the command
+// is only logged.
+func runHook(command string, tgt *target, err error) {
+	cmd := shellCommand(context.Background(), command)
+	cmd.Env = append(os.Environ(),
+		"COLLECT_URL="+strings.Join(tgt.urls, ","),
+		"COLLECT_SOURCE="+tgt.posted,
+		"COLLECT_ERROR="+redact(err.Error()),
+		"COLLECT_STATUS="+strconv.Itoa(tgt.status),
+	)
+
+	hooks.Add(1)
+	go func() {
+		defer hooks.Done()
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Printf("failure hook failed: %v\n%s", err, out)
+		}
+	}()
+}
+
+// shellCommand returns a command which runs a command line in the platform's
+// shell.
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	shell, flag := "sh", "-c"
+	if runtime.GOOS == "windows" {
+		shell, flag = "cmd", "/C"
+	}
+	return exec.CommandContext(ctx, shell, flag, command)
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+// A jitter delays each periodic collection by a random amount up to its max,
+// so that collectors started at the same moment don't all hit their URLs and
+// Librato at once. Each target draws its delays from a generator of its own,
+// seeded by the jitter's seed and the target's position, so a seed gives every
+// target the same schedule however their collections interleave.
+type jitter struct {
+	max  time.Duration
+	seed int64
+}
+
+// newJitter returns a jitter whose delays are drawn from generators with the
+// given seed, or a time-based one if the seed is zero.
+func newJitter(max time.Duration, seed int64) *jitter {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &jitter{max: max, seed: seed}
+}
+
+// delays returns a function which returns how long to delay each of the i'th
+// target's collections in turn. A nil jitter never delays.
+func (j *jitter) delays(i int) func() time.Duration {
+	if j == nil || j.max <= 0 {
+		return func() time.Duration { return 0 }
+	}
+
+	// mixed by the golden ratio, so neighbouring seeds' targets don't share
+	// generators
+	r := rand.New(rand.NewSource(int64(uint64(j.seed) ^ uint64(i)*0x9e3779b97f4a7c15)))
+	return func() time.Duration {
+		return time.Duration(r.Int63n(int64(j.max)))
+	}
+}
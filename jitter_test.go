@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestJitterDelays(t *testing.T) {
+	draw := func(j *jitter, i, n int) []time.Duration {
+		delay := j.delays(i)
+		var d []time.Duration
+		for k := 0; k < n; k++ {
+			d = append(d, delay())
+		}
+		return d
+	}
+
+	tests := []struct {
+		name string
+		a, b []time.Duration
+		same bool
+	}{
+		{"same seed and target", draw(newJitter(time.Second, 42), 0, 5), draw(newJitter(time.Second, 42), 0, 5), true},
+		{"another target", draw(newJitter(time.Second, 42), 0, 5), draw(newJitter(time.Second, 42), 1, 5), false},
+		{"another seed", draw(newJitter(time.Second, 42), 0, 5), draw(newJitter(time.Second, 43), 0, 5), false},
+		{"no jitter", draw(nil, 0, 3), []time.Duration{0, 0, 0}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := fmt.Sprint(tt.a) == fmt.Sprint(tt.b); same != tt.same {
+				t.Errorf("delays %v and %v, want same %v", tt.a, tt.b, tt.same)
+			}
+		})
+	}
+
+	// a target's delays don't depend on how the others' are interleaved with
+	// them
+	j := newJitter(time.Second, 7)
+	first, second := j.delays(0), j.delays(1)
+	var interleaved []time.Duration
+	for k := 0; k < 5; k++ {
+		second()
+		interleaved = append(interleaved, first())
+	}
+	if want := draw(newJitter(time.Second, 7), 0, 5); fmt.Sprint(interleaved) != fmt.Sprint(want) {
+		t.Errorf("interleaved delays %v, want %v", interleaved, want)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+	"github.com/theory/jsonpath"
+	"github.com/theory/jsonpath/spec"
+)
+
+// parseJSONPaths parses the metrics' paths as RFC 9535 JSONPath expressions.
+func parseJSONPaths(metrics ...[]metric) (map[string]*jsonpath.Path, error) {
+	paths := make(map[string]*jsonpath.Path)
+	for _, l := range metrics {
+		for _, m := range l {
+			p, err := jsonpath.Parse(m.path)
+			if err != nil {
+				return nil, fmt.Errorf("bad JSONPath %q: %v", m.path, err)
+			}
+			paths[m.path] = p
+		}
+	}
+	return paths, nil
+}
+
+// expandJSONPaths replaces each metric with one metric per node its JSONPath
+// selects, addressed by the node's normalized path. A metric with no explicit
+// name is named after each node's path (e.g. $.pools[*].size selects
+// pools.0.size, pools.1.size, ...). A metric with an explicit name is posted
+// under that name if it selects a single node, or under the name followed by
+// each node's position if it selects several. A metric which selects nothing
+// is kept as-is, so it's treated as missing, and named after its path.
+func (c *config) expandJSONPaths(doc interface{}, metrics []metric) []metric {
+	var expanded []metric
+	for _, m := range metrics {
+		nodes := c.jsonPaths[m.path].SelectLocated(doc)
+		if len(nodes) == 0 {
+			if m.name == "" {
+				m.name = strings.TrimPrefix(m.path, "$.")
+			}
+			expanded = append(expanded, m)
+			continue
+		}
+
+		for i, n := range nodes {
+			e := m
+			e.segments = make([]string, 0, len(n.Path))
+			for _, sel := range n.Path {
+				switch sel := sel.(type) {
+				case spec.Name:
+					e.segments = append(e.segments, string(sel))
+				case spec.Index:
+					e.segments = append(e.segments, strconv.Itoa(int(sel)))
+				}
+			}
+
+			if m.name != "" && len(nodes) > 1 {
+				e.name = m.name + c.separator + strconv.Itoa(i)
+			}
+			expanded = append(expanded, e)
+		}
+	}
+	return expanded
+}
+
+// expand returns the metrics a configured metric stands for in the document:
+// itself, or with -jsonpath-engine rfc9535, one per node its JSONPath selects,
+// as they're collected.
+func (c *config) expand(jq *jsonq.JsonQuery, m metric) []metric {
+	if c.jsonPaths == nil {
+		return []metric{m}
+	}
+	doc, _ := jq.Object()
+	return c.expandJSONPaths(doc, []metric{m})
+}
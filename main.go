@@ -1,178 +1,2445 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"net"
 	"net/http"
+	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"os/signal"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/template"
 	"time"
+	"unicode/utf8"
 
 	"github.com/jmoiron/jsonq"
+	"github.com/theory/jsonpath"
 )
 
 func main() {
 	var (
-		gaugePaths, counterPaths stringList
-		metricsURL, source       string
-		email, token             string
-		period                   time.Duration
+		cfg         config
+		metricsURLs stringList
+		period      time.Duration
+		minInterval time.Duration
+		mergeFetch  bool
+		streamMode  bool
+		pollCount   int
+		mode        string
+
+		breakerThreshold int
+		breakerInterval  time.Duration
+
+		fetchOpts fetchOptions
+
+		buf            buffer
+		replayInterval time.Duration
+		dump           buffer
+
+		rateLimit        float64
+		postOK           string
+		fetchRetryStatus string
+
+		urlFile   string
+		onFailure string
+		tagsFile  string
+		meta      metadata
+
+		jsonPathEngine string
+		configPath     string
+		localAddr      string
+
+		listPaths       bool
+		summaryInterval time.Duration
+		summaryRanges   bool
+		redactLogs      bool
+		watchdogWindow  time.Duration
+		jitterMax       time.Duration
+		jitterSeed      int64
+		loginURL        string
+		collectOnStart  bool
+		reportPath      string
+		reportAppend    bool
+
+		vlt          vault
+		vaultRefresh time.Duration
 	)
-	flag.StringVar(&metricsURL, "url", "", "URL of the service's metrics")
-	flag.StringVar(&source, "source", "", "an optional source to use instead of the URL's host")
-	flag.Var(&gaugePaths, "gauge", "the JSON path to a gauges's value")
-	flag.Var(&counterPaths, "counter", "the JSON path to a counter's value")
-	flag.StringVar(&email, "email", "", "Librato account email")
-	flag.StringVar(&token, "token", "", "Librato account token")
+	flag.Var(&metricsURLs, "url", "URL of the service's metrics (repeatable, with an optional period as url|period)")
+	flag.StringVar(&urlFile, "url-file", "", "a file of URLs to collect, one per line, each optionally followed by a source")
+	flag.IntVar(&cfg.sourceCount, "source-count", 1, "post each batch this many times, under the source suffixed with -0, -1, ... (for load testing)")
+	flag.StringVar(&cfg.sourceCase, "source-case", "preserve", "lower, upper, or preserve the case of sources, whether they're given or derived")
+	flag.StringVar(&cfg.source, "source", "", "an optional source to use instead of the URL's host (may be a template, e.g. {{.Label}}-{{.Path \"node.id\"}}, which -url-file sources override)")
+	flag.BoolVar(&cfg.passthrough, "passthrough", false, "relay a response which is already a Librato batch of gauges and counters, along with any other metrics")
+	flag.Var(&cfg.gauges, "gauge", "the JSON path to a gauges's value (path[=name][:default])")
+	flag.Var(&cfg.counters, "counter", "the JSON path to a counter's value (path[=name][:default])")
+	flag.Var(&cfg.edgeCounters, "edge-counter", "the JSON path to a boolean, posted as a counter of how often it's gone from false to true (path[=name][:default])")
+	flag.BoolVar(&cfg.countersAsGauges, "counters-as-gauges", false, "post -counter paths as gauges, so no counters are posted at all")
+	flag.Var(&cfg.strlens, "strlen", "the JSON path to a string whose length is posted as a gauge (path[=name][:default])")
+	flag.Var(&cfg.sums, "sum-map", "a gauge of the sum of a field of every value in an object, whatever their keys (object.*.field[=name])")
+	flag.Var(&cfg.matchCounts, "count-matches", "a counter of the objects in an array which match, such as lines from -format ndjson (name=array[], or name=array[].field==value, or !=)")
+	flag.Var(&cfg.gaugeEach, "gauge-each", "a gauge for each object in an array, named by one of its fields (array[].value name=path), and in tagged mode optionally tagged with it too (tag=key)")
+	flag.StringVar(&cfg.email, "email", "", "Librato account email")
+	flag.StringVar(&cfg.token, "token", "", "Librato account token")
+	flag.StringVar(&vlt.path, "vault-path", "", "a Vault secret with email and token fields to read the Librato credentials from, such as secret/data/librato")
+	flag.StringVar(&vlt.addr, "vault-addr", os.Getenv("VAULT_ADDR"), "the address of the Vault server for -vault-path")
+	flag.StringVar(&vlt.token, "vault-token", os.Getenv("VAULT_TOKEN"), "the Vault token for -vault-path")
+	flag.StringVar(&vlt.roleID, "vault-role-id", "", "an AppRole role ID to log in to Vault with instead of -vault-token")
+	flag.StringVar(&vlt.secretID, "vault-secret-id", os.Getenv("VAULT_SECRET_ID"), "the AppRole secret ID for -vault-role-id")
+	flag.DurationVar(&vaultRefresh, "vault-refresh", 10*time.Minute, "how often to re-read -vault-path, so the credentials can be rotated (0 for never)")
 	flag.DurationVar(&period, "period", 0, "send data periodically (0 for just once)")
+	flag.DurationVar(&minInterval, "min-interval", time.Second, "the shortest period allowed, with shorter ones raised to it (0 for no limit)")
+	flag.IntVar(&pollCount, "count", 0, "in periodic mode, exit after collecting each URL this many times, with a summary (0 for no limit)")
+	flag.BoolVar(&collectOnStart, "collect-on-start", true, "in periodic mode, collect as soon as it starts instead of waiting for the first period")
+	flag.BoolVar(&streamMode, "stream", false, "read each URL as a Server-Sent Events stream of JSON documents, posting the latest values every -period")
+	flag.DurationVar(&jitterMax, "jitter", 0, "delay each periodic collection by a random amount up to this long")
+	flag.Int64Var(&jitterSeed, "jitter-seed", 0, "seed -jitter's random delays, for a reproducible schedule (0 for a time-based seed)")
+	flag.BoolVar(&mergeFetch, "merge-fetch", false, "deep-merge all URLs' responses into one document (later URLs win)")
+	flag.Var(&cfg.consts, "const", "a constant gauge to send with every batch (name=value)")
+	flag.StringVar(&cfg.prefix, "prefix", "", "an optional prefix for all metric names")
+	flag.StringVar(&cfg.gaugeSuffix, "gauge-suffix", "", "a suffix for every gauge's name, such as .gauge")
+	flag.StringVar(&cfg.counterSuffix, "counter-suffix", "", "a suffix for every counter's name, such as .count")
+	flag.StringVar(&cfg.separator, "namespace-separator", ".", "the separator between a metric name's prefix and path components (e.g. ':')")
+	flag.IntVar(&breakerThreshold, "breaker-threshold", 0, "consecutive failures before backing off a URL (0 to never back off)")
+	flag.DurationVar(&breakerInterval, "breaker-interval", 5*time.Minute, "how often to probe a URL which has been backed off")
+	flag.Var(&cfg.units, "parse-units", "a -gauge or -counter path whose values are strings with units, parsed into bytes or seconds (e.g. 1.5GB, 200ms)")
+	flag.BoolVar(&cfg.strict, "jsonq-strict", false, "fail on a counter which isn't an integer, or a -parse-units value which can't be parsed, instead of truncating or skipping it")
+	flag.BoolVar(&cfg.skipNonNumeric, "skip-non-numeric", false, "skip a -gauge or -counter whose value is a string which isn't a number, with a warning, instead of failing")
+	flag.BoolVar(&cfg.coerceStrings, "coerce-strings", false, "parse numeric values which are encoded as JSON strings")
+	flag.BoolVar(&cfg.dropUnchangedCounters, "drop-unchanged-counters", false, "skip re-posting counters which haven't changed, posting them at least once per -unchanged-counter-interval")
+	flag.DurationVar(&cfg.unchangedCounterInterval, "unchanged-counter-interval", 10*time.Minute, "how often -drop-unchanged-counters re-posts an unchanged counter")
+	flag.DurationVar(&cfg.dedupeWindow, "dedupe", 0, "skip re-posting unchanged values, posting at least once per this window (0 to always post)")
+	flag.StringVar(&fetchOpts.clientCert, "client-cert", "", "a PEM-encoded client certificate to present to the URL")
+	flag.StringVar(&fetchOpts.clientKey, "client-key", "", "the PEM-encoded private key for -client-cert")
+	flag.IntVar(&fetchOpts.maxRedirects, "max-redirects", 3, "the most redirects to follow when fetching (0 for none)")
+	flag.BoolVar(&fetchOpts.sameHostRedirects, "same-host-redirects", false, "refuse to follow redirects to other hosts when fetching")
+	flag.StringVar(&fetchOpts.tlsMinVersion, "tls-min-version", "", "the oldest TLS version to fetch over: 1.0, 1.1, 1.2, or 1.3 (Go's default if unset)")
+	flag.StringVar(&fetchOpts.tlsCiphers, "tls-ciphers", "", "a comma-separated list of the TLS 1.0-1.2 cipher suites to fetch over, like TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 (Go's default if unset)")
+	flag.BoolVar(&fetchOpts.http2, "http2", true, "use HTTP/2 for fetching and posting when the server supports it")
+	flag.StringVar(&localAddr, "local-addr", "", "the local IP address to fetch and post from, for firewalls which allow only some")
+	flag.DurationVar(&fetchOpts.dnsCacheTTL, "dns-cache-ttl", 0, "cache the addresses of the URLs' hosts for this long, which can hide their addresses changing (0 for no cache)")
+	flag.StringVar(&fetchOpts.oauthTokenURL, "oauth-token-url", "", "an OAuth2 token endpoint to get a bearer token for fetching from, with a client credentials grant")
+	flag.StringVar(&fetchOpts.oauthClientID, "oauth-client-id", "", "the client ID for -oauth-token-url")
+	flag.StringVar(&fetchOpts.oauthClientSecret, "oauth-client-secret", "", "the client secret for -oauth-token-url")
+	flag.StringVar(&fetchOpts.oauthScopes, "oauth-scopes", "", "the space-separated scopes to request from -oauth-token-url")
+	flag.StringVar(&fetchOpts.awsRegion, "aws-region", "", "an AWS region to sign fetches for with SigV4")
+	flag.StringVar(&fetchOpts.awsService, "aws-service", "execute-api", "the AWS service to sign fetches for with -aws-region")
+	flag.StringVar(&fetchOpts.awsAccessKey, "aws-access-key-id", "", "the AWS access key to sign fetches with (defaults to the environment's, or the instance role's)")
+	flag.StringVar(&fetchOpts.awsSecretKey, "aws-secret-access-key", "", "the AWS secret key for -aws-access-key-id")
+	flag.IntVar(&cfg.postConcurrency, "post-concurrency", 1, "the number of chunks of a large batch to post in parallel")
+	flag.Var(&cfg.allow, "allow", "a glob of metric names to post, such as jvm.* (repeatable; all if none are given)")
+	flag.Var(&cfg.thresholds, "threshold", "log a warning whenever a metric is beyond a bound (name:>value or name:<value)")
+	flag.Var(&cfg.conditions, "when", "only post metrics while a condition holds, such as 'queue.enabled==true metrics=queue.*' (all of them without metrics=)")
+	flag.Var(&cfg.deny, "deny", "a glob of metric names not to post, even if -allow matches them (repeatable)")
+	flag.Var(&cfg.transforms, "transform", "arithmetic applied to a metric's value (name=expression, e.g. bytes=/1048576)")
+	flag.BoolVar(&cfg.sharedTime, "shared-time", false, "stamp each batch with the time its collection started, unless -time-path gives one")
+	flag.StringVar(&cfg.timePath, "time-path", "", "the JSON path to the measurement time, in epoch seconds or RFC 3339")
+	flag.StringVar(&cfg.ageMetric, "age-metric", "", "the name of a gauge of how many seconds old the -time-path time is")
+	flag.DurationVar(&cfg.maxTimeSkew, "max-time-skew", 0, "the most -time-path may differ from now (0 for any amount)")
+	flag.StringVar(&cfg.skewAction, "skew-action", "now", "what to do when -max-time-skew is exceeded: now (use the current time) or drop (skip the batch)")
+	flag.StringVar(&buf.dir, "buffer-dir", "", "a directory in which to keep batches which fail to post, for replaying later")
+	flag.IntVar(&buf.max, "buffer-max", 1000, "the most batches to keep in -buffer-dir (0 for no limit)")
+	flag.DurationVar(&buf.maxAge, "buffer-max-age", 24*time.Hour, "the oldest batch to keep in -buffer-dir (0 for no limit)")
+	flag.StringVar(&dump.dir, "post-dump-dir", "", "a directory to keep a copy of every posted body in, named by when it was posted")
+	flag.IntVar(&dump.max, "post-dump-max", 1000, "the most bodies to keep in -post-dump-dir (0 for no limit)")
+	flag.DurationVar(&dump.maxAge, "post-dump-max-age", 24*time.Hour, "the oldest body to keep in -post-dump-dir (0 for no limit)")
+	flag.DurationVar(&replayInterval, "buffer-replay-interval", time.Minute, "how often to replay batches from -buffer-dir")
+	flag.BoolVar(&listPaths, "list-paths", false, "print the path, value, and type of every numeric value in the response, then exit")
+	flag.StringVar(&cfg.acceptEncoding, "accept-encoding", "gzip, deflate, br", "the Accept-Encoding to request the URL with (empty for Go's default)")
+	flag.DurationVar(&watchdogWindow, "watchdog", 0, "exit with status 3 if nothing has been posted in this long, so a supervisor restarts it; must be longer than -batch-interval (0 for never)")
+	flag.StringVar(&reportPath, "report-json", "", "a file to write a JSON report of the most recent collection to")
+	flag.BoolVar(&reportAppend, "report-append", false, "append each collection's report to -report-json as a line, instead of replacing it")
+	flag.DurationVar(&summaryInterval, "summary-interval", 0, "how often to log a summary of recent collections (0 for never)")
+	flag.BoolVar(&summaryRanges, "summary-ranges", false, "include the lowest and highest value posted of each metric since the last summary in -summary-interval summaries")
+	flag.IntVar(&cfg.postRetries, "post-retries", 2, "how many times to retry a failed post")
+	flag.DurationVar(&cfg.retryBackoff, "retry-backoff", time.Second, "how long to wait before the first retry, doubling with each retry")
+	flag.StringVar(&cfg.idempotencyHeader, "idempotency-header", "Idempotency-Key", "the header in which to send each post's idempotency key (empty for none)")
+	flag.Float64Var(&rateLimit, "rate-limit", 0, "the most measurements to post per second (0 for no limit)")
+	flag.StringVar(&cfg.format, "format", "json", "the format of the URL's response: json, yaml, toml, xml, form (key=value&...), or ndjson (as an array named lines)")
+	flag.StringVar(&fetchRetryStatus, "fetch-retry-status", "", "comma-separated HTTP statuses which mean a fetch should be retried after -retry-backoff")
+	flag.IntVar(&cfg.fetchRetries, "fetch-retries", 3, "how many times to retry a fetch with a -fetch-retry-status")
+	flag.StringVar(&postOK, "post-ok-status", "", "comma-separated HTTP statuses which mean a post succeeded (by default, 200 from Librato, or any 2xx from -ndjson-url or -remote-write-url)")
+	flag.Float64Var(&cfg.sampleRate, "sample-rate", 1, "the probability of posting each measurement, with counters scaled up to match (0-1)")
+	flag.BoolVar(&cfg.failOnEmpty, "fail-on-empty", false, "treat a collection which finds no gauges or counters as a failure")
+	flag.BoolVar(&cfg.dropNA, "drop-na", true, "drop gauges whose values are NaN or infinite, which can't be posted")
+	flag.BoolVar(&cfg.debug, "debug", false, "log each fetched document and what each configured path resolved to")
+	flag.BoolVar(&cfg.fetchMetrics, "fetch-metrics", false, "send gauges of each fetch's HTTP status and latency")
+	flag.BoolVar(&cfg.tagged, "tagged", false, "post to Librato's tagged measurements API instead of the source-based one")
+	flag.Var(&cfg.tags, "tag", "a tag for all measurements in tagged mode (name=value)")
+	flag.Var(&cfg.tagPaths, "tag-from-path", "a tag whose value is read from the document in tagged mode (name=path)")
+	flag.StringVar(&tagsFile, "tags-file", "", "a JSON or YAML file of tags for all measurements in tagged mode")
+	flag.StringVar(&meta.url, "metadata-url", "", "a JSON metadata endpoint to read the default source and tags from at startup")
+	flag.StringVar(&meta.source, "metadata-source", "", "the path in -metadata-url to the default source")
+	flag.Var(&meta.tags, "metadata-tag", "a default tag read from -metadata-url (name=path)")
+	flag.DurationVar(&cfg.batchInterval, "batch-interval", 0, "accumulate polls and post their aggregate once per this interval (0 to post every poll)")
+	flag.StringVar(&cfg.gaugeAggregate, "gauge-aggregate", "avg", "how -batch-interval aggregates gauges: avg, min, max, last, or summary (an aggregate gauge of count, sum, min, max, and sum of squares)")
+	flag.StringVar(&cfg.counterAggregate, "counter-aggregate", "last", "how -batch-interval aggregates counters: sum or last")
+	flag.StringVar(&cfg.ndjsonURL, "ndjson-url", "", "a URL to post each batch's measurements to as newline-delimited JSON instead of Librato")
+	flag.Var(&extraFields, "extra-field", "a field to add to every posted measurement, for API fields without a flag of their own; Librato may reject the post if it's wrong (key=JSON, repeatable)")
+	flag.StringVar(&cfg.batchIDTag, "batch-id-tag", "", "in tagged mode, a tag to give each collection's measurements a new random ID under, which is also logged")
+	flag.StringVar(&cfg.batchIDHeader, "batch-id-header", "", "a header to send each collection's random ID in when posting, which is also logged")
+	flag.StringVar(&cfg.remoteWriteURL, "remote-write-url", "", "a Prometheus remote-write endpoint to post each batch to instead of Librato")
+	flag.StringVar(&cfg.execSink, "exec-sink", "", "a shell command to send each batch's JSON to on stdin instead of posting it to Librato")
+	flag.StringVar(&cfg.paginatePath, "paginate-path", "", "the JSON path to the next page's URL or cursor, to collect every page of a paginated response")
+	flag.StringVar(&cfg.paginateParam, "paginate-param", "cursor", "the query parameter to send a -paginate-path cursor as")
+	flag.IntVar(&cfg.maxPages, "max-pages", 10, "the most pages to fetch with -paginate-path")
+	flag.DurationVar(&cfg.perURLTimeout, "per-url-timeout", 0, "how long fetching and decoding each URL may take, retries included (0 for no limit)")
+	flag.DurationVar(&cfg.collectTimeout, "collect-timeout", 0, "how long each collection may take, from fetching to posting, retries and pages included (0 for no limit)")
+	flag.BoolVar(&cfg.postGzip, "post-gzip", false, "gzip the bodies of posts larger than -post-compression-threshold")
+	flag.IntVar(&cfg.compressionThreshold, "post-compression-threshold", 4096, "how many bytes a body must exceed for -post-gzip to compress it")
+	flag.StringVar(&cfg.postMethod, "post-method", "POST", "the HTTP method to post batches with")
+	flag.Var(&cfg.postHeaders, "post-header", "an extra header to post batches with, overriding any default (Name: Value)")
+	flag.StringVar(&configPath, "config", "", "a file of more -gauge, -counter, and -tag flags, one per line, which is re-read on SIGHUP")
+	flag.StringVar(&jsonPathEngine, "jsonpath-engine", "dotted", "how -gauge and -counter paths are written: dotted (a.b.0.c) or rfc9535 ($.a.b[0].c)")
+	flag.IntVar(&gaugePrecision, "gauge-precision", -1, "post gauges with this many decimal places and no exponent (-1 for Go's default formatting)")
+	flag.DurationVar(&cfg.staleAfter, "stale-after", 0, "skip posting when -time-path hasn't advanced in this long (0 to always post)")
+	flag.StringVar(&cfg.sequenceName, "sequence-name", "", "the name of a gauge which goes up by one with every collection, to show missed ones")
+	flag.BoolVar(&cfg.selfMetrics, "self-metrics", false, "send metrics about the collector itself, under collector")
+	flag.StringVar(&onFailure, "on-failure", "", "a shell command to run when a collection fails, with COLLECT_URL, COLLECT_SOURCE, COLLECT_ERROR, and COLLECT_STATUS set")
+	flag.StringVar(&cfg.grpcRequest, "grpc-request", "{}", "the JSON request to send to grpc:// and grpcs:// URLs (which need a build with -tags grpc)")
+	flag.Var(&cfg.cookies, "cookie", "a cookie to send with each fetch (name=value)")
+	flag.StringVar(&loginURL, "login-url", "", "a URL to fetch once at startup, keeping any session cookies it sets for later fetches")
+	flag.Var(&cfg.query, "query", "a query parameter to add to each URL, replacing any with the same key (key=value)")
+	flag.BoolVar(&redactLogs, "redact", true, "redact the email, token, Authorization headers, OAuth2 tokens, session cookies, and URL passwords from the logs")
+	flag.StringVar(&mode, "mode", "fail-fast", "fail-fast (abort on the first error) or best-effort (collect what's possible)")
 	flag.Parse()
 
-	if metricsURL == "" {
-		fmt.Fprintln(os.Stderr, "No URL provided")
-		flag.Usage()
-		os.Exit(1)
+	redacting = redactLogs
+	if redactLogs {
+		// secrets obtained later, e.g. from Vault, are redacted as they're added
+		log.SetOutput(redactWriter{os.Stderr})
+		if cfg.token != "" {
+			redactSecrets(cfg.email, cfg.token, strings.TrimPrefix(basicAuth(cfg.email, cfg.token), "Basic "))
+		}
+		redactSecrets(headerSecrets(cfg.postHeaders)...)
+		redactSecrets(fetchOpts.oauthClientSecret, fetchOpts.awsSecretKey, os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"))
+		redactSecrets(vlt.token, vlt.secretID)
+		for _, c := range cfg.cookies {
+			redactSecrets(c.Value)
+		}
+		redactSecrets(urlSecrets(append([]string{meta.url}, metricsURLs...))...)
+	}
+
+	// -tag overrides -tags-file, which overrides -metadata-tag
+	if tagsFile != "" {
+		if err := loadTagsFile(tagsFile, &cfg.tags); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if meta.url != "" {
+		if err := meta.apply(&cfg); err != nil {
+			fmt.Fprintf(stderr, "unable to read metadata: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	// each URL may have its own source, if it's from -url-file
+	sources := make([]string, len(metricsURLs))
+	for i := range sources {
+		sources[i] = cfg.source
+	}
+	if urlFile != "" {
+		fileURLs, fileSources, err := readURLFile(urlFile)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+		for i, u := range fileURLs {
+			metricsURLs = append(metricsURLs, u)
+			if fileSources[i] == "" {
+				fileSources[i] = cfg.source
+			}
+			sources = append(sources, fileSources[i])
+		}
+		if redactLogs {
+			redactSecrets(urlSecrets(fileURLs)...)
+		}
+	}
+
+	if len(metricsURLs) == 0 {
+		fmt.Fprintln(stderr, "No URL provided")
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch mode {
+	case "fail-fast":
+	case "best-effort":
+		cfg.bestEffort = true
+	default:
+		fmt.Fprintf(stderr, "Unknown mode: %s\n", mode)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch cfg.format {
+	case "json", "yaml", "toml", "ndjson", "xml", "form":
+	default:
+		fmt.Fprintf(stderr, "Unknown format: %s\n", cfg.format)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := validAggregate(cfg.gaugeAggregate, "avg", "min", "max", "last", "summary"); err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(1)
+	}
+	if err := validAggregate(cfg.counterAggregate, "sum", "last"); err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(1)
+	}
+
+	if jsonPathEngine != "dotted" && jsonPathEngine != "rfc9535" {
+		fmt.Fprintf(stderr, "Unknown JSONPath engine: %s\n", jsonPathEngine)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var conf *configFile
+	if configPath != "" {
+		conf = &configFile{path: configPath, gauges: cfg.gauges, counters: cfg.counters, tags: cfg.tags}
+		var err error
+		cfg.gauges, cfg.counters, cfg.tags, err = conf.load()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	if err := cfg.preparePaths(jsonPathEngine); err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(1)
+	}
+
+	switch cfg.sourceCase {
+	case "lower", "upper", "preserve":
+	default:
+		fmt.Fprintf(stderr, "Unknown source case: %s\n", cfg.sourceCase)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if cfg.skewAction != "now" && cfg.skewAction != "drop" {
+		fmt.Fprintf(stderr, "Unknown skew action: %s\n", cfg.skewAction)
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if cfg.sampleRate <= 0 || cfg.sampleRate > 1 {
+		fmt.Fprintf(stderr, "Bad sample rate: %v\n", cfg.sampleRate)
+		os.Exit(1)
+	}
+
+	// counters read as gauges, so their values aren't truncated either
+	if cfg.countersAsGauges {
+		cfg.gauges = append(cfg.gauges, cfg.counters...)
+		cfg.counters = nil
+	}
+
+	if cfg.postConcurrency < 1 {
+		cfg.postConcurrency = 1
+	}
+
+	tmpl, err := parseSource(cfg.source)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(1)
+	}
+	cfg.sourceTemplate = tmpl
+
+	cfg.sink, err = newSink(&cfg)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(1)
+	}
+	if postOK != "" {
+		cfg.postOK, err = parseStatuses(postOK)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+	} else if _, ok := cfg.sink.(libratoSink); ok {
+		cfg.postOK = map[int]bool{200: true}
+	}
+	if fetchRetryStatus != "" {
+		cfg.fetchRetryStatus, err = parseStatuses(fetchRetryStatus)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	period = clampPeriod("-period", period, minInterval)
+
+	// a URL may have its own period, as url|period
+	urls := make([]string, len(metricsURLs))
+	periods := make([]time.Duration, len(metricsURLs))
+	periodic := false
+	for i, u := range metricsURLs {
+		urls[i], periods[i], err = splitPeriod(u, period)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+		if _, err := url.Parse(urls[i]); err != nil {
+			fmt.Fprintf(stderr, "Bad URL: %v\n", err)
+			os.Exit(1)
+		}
+		periods[i] = clampPeriod(urls[i], periods[i], minInterval)
+		if periods[i] > 0 {
+			periodic = true
+		} else if streamMode {
+			fmt.Fprintln(stderr, "-stream requires a period for every URL")
+			os.Exit(1)
+		}
+	}
+
+	if rateLimit > 0 {
+		cfg.limiter = newLimiter(rateLimit)
+	}
+
+	if localAddr != "" {
+		fetchOpts.localAddr, err = bindableAddr(localAddr)
+		if err != nil {
+			fmt.Fprintf(stderr, "Bad local address: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	cfg.fetcher, err = newFetchClient(fetchOpts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		os.Exit(1)
+	}
+	cfg.poster = newPostClient(fetchOpts.http2, fetchOpts.localAddr)
+
+	if vlt.path != "" {
+		vlt.client = &http.Client{Timeout: 10 * time.Second}
+		if err := vlt.load(); err != nil {
+			fmt.Fprintf(stderr, "unable to read credentials from Vault at %s: %v\n", vlt.addr, err)
+			os.Exit(1)
+		}
+		cfg.vault = &vlt
+		if vaultRefresh > 0 && periodic {
+			go vlt.run(vaultRefresh)
+		}
+	}
+	cfg.report = reportPath != ""
+
+	// a login sets a session cookie, which the jar sends with every fetch
+	if loginURL != "" {
+		cfg.fetcher.Jar, _ = cookiejar.New(nil)
+		if err := login(&cfg, loginURL); err != nil {
+			fmt.Fprintf(stderr, "unable to log in: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if listPaths {
+		for _, u := range urls {
+			printPaths(os.Stdout, fetchMetrics(context.Background(), &cfg, u, &fetchResult{}))
+		}
+		return
+	}
+
+	if dump.dir != "" {
+		if err := os.MkdirAll(dump.dir, 0700); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+		cfg.dump = &dump
+	}
+
+	if buf.dir != "" {
+		if err := os.MkdirAll(buf.dir, 0700); err != nil {
+			fmt.Fprintln(stderr, err)
+			os.Exit(1)
+		}
+		cfg.buffer = &buf
+
+		cfg.buffer.replay(&cfg)
+		if periodic {
+			go cfg.buffer.run(&cfg, replayInterval)
+		}
+	}
+
+	if summaryInterval > 0 && periodic {
+		if summaryRanges {
+			cfg.stats.ranges = make(map[string]valueRange)
+		}
+		go cfg.stats.run(summaryInterval)
+	}
+
+	if watchdogWindow > 0 && cfg.batchInterval > 0 && watchdogWindow <= cfg.batchInterval {
+		// nothing's posted until each interval ends
+		fmt.Fprintf(stderr, "-watchdog (%s) must be longer than -batch-interval (%s)\n", watchdogWindow, cfg.batchInterval)
+		os.Exit(1)
+	}
+	if watchdogWindow > 0 && periodic {
+		cfg.watchdog = newWatchdog(watchdogWindow)
+	}
+
+	// a source template only applies to URLs without a source of their own, and
+	// until it's rendered they fall back to the URL's host
+	templated := make([]bool, len(sources))
+	for i := range sources {
+		if cfg.sourceTemplate != nil && sources[i] == cfg.source {
+			sources[i], templated[i] = "", true
+		}
+	}
+
+	// with -merge-fetch, all the URLs are collected together every -period
+	var targets []*target
+	if mergeFetch {
+		targets = append(targets, &target{
+			urls:      urls,
+			source:    sourceFor(sources[0], urls[0]),
+			derived:   sources[0] == "",
+			templated: templated[0],
+			period:    period,
+		})
+	} else {
+		for i, u := range urls {
+			targets = append(targets, &target{
+				urls:      []string{u},
+				source:    sourceFor(sources[i], u),
+				derived:   sources[i] == "",
+				templated: templated[i],
+				period:    periods[i],
+			})
+		}
+	}
+	for _, tgt := range targets {
+		tgt.breaker = breaker{threshold: breakerThreshold, interval: breakerInterval}
+		tgt.polls = pollCount
+		if streamMode {
+			for _, u := range tgt.urls {
+				s := &stream{url: u}
+				tgt.streams = append(tgt.streams, s)
+				go s.run(&cfg)
+			}
+		}
+	}
+
+	failed := false
+	collectTarget := func(tgt *target, now time.Time) {
+		if !tgt.breaker.allow(now) {
+			return
+		}
+
+		// a tick which fired while the previous collection was still running
+		// would just duplicate it
+		if now.Before(tgt.finished) {
+			tgt.skipped++
+			log.Printf("warning: skipping %s, the previous collection overran its period", strings.Join(tgt.urls, ","))
+			return
+		}
+
+		log.Printf("collecting %s", strings.Join(tgt.urls, ","))
+		start := time.Now()
+		err := collect(tgt, &cfg)
+		tgt.finished = time.Now()
+		cfg.stats.collected(tgt.finished.Sub(start), err)
+		tgt.breaker.record(strings.Join(tgt.urls, ","), err, now)
+		if reportPath != "" {
+			if rerr := tgt.report.write(reportPath, reportAppend, err, tgt.finished); rerr != nil {
+				log.Printf("unable to write report: %v", rerr)
+			}
+		}
+		if err != nil {
+			failed = true
+			if onFailure != "" {
+				runHook(onFailure, tgt, err)
+			}
+		}
+	}
+
+	// a reload signal re-reads the -config file, between collections so none
+	// sees half of the old config and half of the new
+	var reload chan os.Signal
+	if conf != nil && periodic && len(reloadSignals) > 0 {
+		reload = make(chan os.Signal, 1)
+		signal.Notify(reload, reloadSignals...)
+	}
+
+	// in periodic mode, a poll signal triggers an immediate collection
+	var poll chan os.Signal
+	if periodic && len(pollSignals) > 0 {
+		poll = make(chan os.Signal, 1)
+		signal.Notify(poll, pollSignals...)
+	}
+
+	// streams never end on their own, so a termination signal flushes their
+	// latest values before exiting
+	var term chan os.Signal
+	if streamMode {
+		term = make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	}
+
+	var j *jitter
+	if jitterMax > 0 {
+		j = newJitter(jitterMax, jitterSeed)
+	}
+	ticks := schedule(targets, j, collectOnStart)
+	for {
+		select {
+		case tick, ok := <-ticks:
+			if !ok {
+				hooks.Wait()
+				if pollCount > 0 && periodic {
+					cfg.stats.summarize()
+				}
+				if failed {
+					os.Exit(1)
+				}
+				return
+			}
+			collectTarget(tick.target, tick.now)
+		case sig := <-reload:
+			if err := cfg.reload(conf, jsonPathEngine); err != nil {
+				log.Printf("unable to reload %s on %v, keeping the current config: %v", conf.path, sig, err)
+			} else {
+				log.Printf("reloaded %s on %v", conf.path, sig)
+			}
+		case sig := <-poll:
+			log.Printf("collection manually triggered by %v", sig)
+			for _, tgt := range targets {
+				collectTarget(tgt, time.Now())
+			}
+		case sig := <-term:
+			log.Printf("flushing streams and exiting on %v", sig)
+			for _, tgt := range targets {
+				collectTarget(tgt, time.Now())
+			}
+			hooks.Wait()
+			if failed {
+				os.Exit(1)
+			}
+			return
+		}
+	}
+}
+
+// readURLFile reads a file of URLs, one per line, each optionally followed by
+// whitespace and a source. Blank lines and lines starting with '#' are skipped.
+func readURLFile(name string) (urls, sources []string, err error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 2 {
+			return nil, nil, fmt.Errorf("%s:%d: expected a URL and an optional source", name, n)
+		}
+
+		urls = append(urls, fields[0])
+		if len(fields) == 2 {
+			sources = append(sources, fields[1])
+		} else {
+			sources = append(sources, "")
+		}
+	}
+	return urls, sources, scanner.Err()
+}
+
+// clampPeriod returns the period, or -min-interval if the period is shorter,
+// since a typo like -period 100ms would hammer both the endpoint and Librato.
+func clampPeriod(name string, period, min time.Duration) time.Duration {
+	if period > 0 && period < min {
+		log.Printf("warning: the period for %s is %s, which is less than -min-interval; using %s", name, period, min)
+		return min
+	}
+	return period
+}
+
+// splitPeriod splits a URL of the form url|period into its URL and period,
+// which defaults to the given period.
+func splitPeriod(u string, period time.Duration) (string, time.Duration, error) {
+	i := strings.LastIndex(u, "|")
+	if i < 0 {
+		return u, period, nil
+	}
+
+	p, err := time.ParseDuration(u[i+1:])
+	if err != nil {
+		return "", 0, fmt.Errorf("bad period for %s: %v", u[:i], err)
+	}
+	return u[:i], p, nil
+}
+
+// A tick is a scheduled collection of a target.
+type tick struct {
+	target *target
+	now    time.Time
+}
+
+// schedule returns a channel of ticks for every target, each on its own
+// period. It's closed once every target which is only collected once has been.
+func schedule(targets []*target, j *jitter, immediate bool) <-chan tick {
+	ticks := make(chan tick)
+
+	var wg sync.WaitGroup
+	for i, tgt := range targets {
+		wg.Add(1)
+		go func(tgt *target, delay func() time.Duration) {
+			defer wg.Done()
+			for now := range ticker(tgt.period, immediate) {
+				if d := delay(); d > 0 && tgt.period > 0 {
+					time.Sleep(d)
+					now = time.Now()
+				}
+				ticks <- tick{target: tgt, now: now}
+
+				// with -count, a periodic target stops after that many
+				// collections
+				if tgt.polls > 0 {
+					if tgt.polls--; tgt.polls == 0 {
+						return
+					}
+				}
+			}
+		}(tgt, j.delays(i))
+	}
+
+	go func() {
+		wg.Wait()
+		close(ticks)
+	}()
+
+	return ticks
+}
+
+// measureTime sets the batch's measurement time from the response's -time-path,
+// if any. If the source's time is more than -max-time-skew from now, the batch
+// is either measured now or, with -skew-action drop, dropped, in which case
+// measureTime returns false. It also returns false if the source's time hasn't
+// advanced in more than -stale-after.
+func (c *config) measureTime(key string, jq *jsonq.JsonQuery, b *batch, now time.Time, t *tally) bool {
+	if c.timePath == "" {
+		return true
+	}
+
+	ts, err := sourceTime(jq, c.timePath)
+	if err != nil {
+		t.fail(fmt.Errorf("%s: %v", c.timePath, err))
+		return true
+	}
+	if c.ageMetric != "" {
+		c.addAge(b, ts, now)
+	}
+
+	if c.staleAfter > 0 && c.frozen(key, ts, now) {
+		return false
+	}
+
+	if c.maxTimeSkew > 0 {
+		skew := ts.Sub(now)
+		if skew < 0 {
+			skew = -skew
+		}
+
+		if skew > c.maxTimeSkew {
+			if c.skewAction == "drop" {
+				log.Printf("  source time %s is %s from now, dropping batch", ts, skew)
+				return false
+			}
+			log.Printf("  source time %s is %s from now, using current time", ts, skew)
+			return true
+		}
+	}
+
+	b.MeasureTime = ts.Unix()
+	return true
+}
+
+// addAge adds a gauge of how many seconds old the source's time is. A time at
+// or before the epoch isn't a real time, so no age is posted for it, and one in
+// the future is taken to be brand new.
+func (c *config) addAge(b *batch, ts, now time.Time) {
+	if ts.Unix() <= 0 {
+		log.Printf("  source time %s is implausible, not posting its age", ts)
+		return
+	}
+
+	age := now.Sub(ts).Seconds()
+	if age < 0 {
+		log.Printf("  source time %s is ahead of now, posting an age of 0", ts)
+		age = 0
+	}
+
+	name := c.qualify(c.ageMetric)
+	b.Gauges[name] = gauge{Value: age}
+	log.Printf("  %s=%v", name, age)
+}
+
+// frozen returns true if the source's time has been the same for longer than
+// -stale-after, which means its exporter has probably hung.
+func (c *config) frozen(key string, ts, now time.Time) bool {
+	if c.sourceTimes == nil {
+		c.sourceTimes = make(map[string]sourceTimestamp)
+	}
+
+	prev, ok := c.sourceTimes[key]
+	if !ok || !prev.ts.Equal(ts) {
+		c.sourceTimes[key] = sourceTimestamp{ts: ts, seen: now}
+		return false
+	}
+
+	if stale := now.Sub(prev.seen); stale > c.staleAfter {
+		log.Printf("  source time %s hasn't advanced in %s, source appears frozen", ts, stale)
+		return true
+	}
+	return false
+}
+
+// A sourceTimestamp is a source's time, and when it was first seen.
+type sourceTimestamp struct {
+	ts, seen time.Time
+}
+
+// sourceTime returns the time at the given path, either in seconds since the
+// epoch or as an RFC 3339 string.
+func sourceTime(jq *jsonq.JsonQuery, path string) (time.Time, error) {
+	v, err := jq.Interface(strings.Split(path, ".")...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if n, ok := v.(json.Number); ok {
+		f, err := n.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		v = f
+	}
+
+	switch v := v.(type) {
+	case float64:
+		sec, frac := math.Modf(v)
+		return time.Unix(int64(sec), int64(frac*1e9)), nil
+	case string:
+		return time.Parse(time.RFC3339, v)
+	}
+	return time.Time{}, fmt.Errorf("expected a timestamp, got %v", v)
+}
+
+// dedupe removes any metrics from the batch whose values haven't changed since
+// they were last posted, unless that was more than the dedupe window ago.
+func (c *config) dedupe(b *batch, now time.Time) {
+	gaugeWindow, counterWindow := c.dedupeWindows()
+	if gaugeWindow == 0 && counterWindow == 0 {
+		return
+	}
+
+	unchanged := func(key, v string, window time.Duration) bool {
+		p, ok := c.posted[key]
+		return ok && p.value == v && now.Sub(p.at) < window
+	}
+
+	for name, g := range b.Gauges {
+		if unchanged(postingKey(b.Source, "gauge", name), formatGauge(g.Value), gaugeWindow) {
+			log.Printf("  %s unchanged, skipping", name)
+			delete(b.Gauges, name)
+		}
+	}
+
+	for name, v := range b.Counters {
+		if unchanged(postingKey(b.Source, "counter", name), formatCounter(v.Value), counterWindow) {
+			log.Printf("  %s unchanged, skipping", name)
+			delete(b.Counters, name)
+		}
+	}
+}
+
+// dedupeWindows returns how often unchanged gauges and counters are re-posted,
+// or zero if they're always posted. -drop-unchanged-counters gives counters
+// their own window.
+func (c *config) dedupeWindows() (gauges, counters time.Duration) {
+	gauges, counters = c.dedupeWindow, c.dedupeWindow
+	if c.dropUnchangedCounters {
+		counters = c.unchangedCounterInterval
+	}
+	return gauges, counters
+}
+
+// remember records the values of a posted batch for deduplication.
+func (c *config) remember(b batch, now time.Time) {
+	if gaugeWindow, counterWindow := c.dedupeWindows(); gaugeWindow == 0 && counterWindow == 0 {
+		return
+	}
+
+	if c.posted == nil {
+		c.posted = make(map[string]posting)
+	}
+
+	for name, g := range b.Gauges {
+		c.posted[postingKey(b.Source, "gauge", name)] = posting{value: formatGauge(g.Value), at: now}
+	}
+
+	for name, v := range b.Counters {
+		c.posted[postingKey(b.Source, "counter", name)] = posting{value: formatCounter(v.Value), at: now}
+	}
+}
+
+// formatGauge and formatCounter format values exactly, for comparison.
+func formatGauge(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func formatCounter(v int64) string {
+	return strconv.FormatInt(v, 10)
+}
+
+func postingKey(source, kind, name string) string {
+	return source + "/" + kind + "/" + name
+}
+
+// A target is a set of URLs which are collected into a single batch.
+type target struct {
+	urls      []string
+	source    string
+	derived   bool // whether the source is the URL's host, since none was given
+	templated bool // whether the source is rendered from the -source template
+	period    time.Duration
+	breaker   breaker
+	finished  time.Time // when the last collection finished
+	skipped   int64     // ticks skipped because a collection overran
+	status    int       // the HTTP status of the last fetch
+	posted    string    // the source of the last collection, as it's posted
+	streams   []*stream // with -stream, each URL's stream
+	report    *report   // with -report-json, the last collection's report
+	polls     int       // with -count, how many more times to collect
+	sequence  int64     // with -sequence-name, the number of collections so far
+}
+
+// A breaker stops collecting from a target after a number of consecutive
+// failures, probing it once per interval until a collection succeeds again.
+type breaker struct {
+	threshold int
+	interval  time.Duration
+	failures  int
+	probe     time.Time
+}
+
+// allow returns true if the target should be collected at the given time.
+func (b *breaker) allow(now time.Time) bool {
+	return !b.open() || !now.Before(b.probe)
+}
+
+func (b *breaker) open() bool {
+	return b.threshold > 0 && b.failures >= b.threshold
+}
+
+// record updates the breaker with the result of a collection of the URLs.
+func (b *breaker) record(urls string, err error, now time.Time) {
+	if err == nil {
+		if b.open() {
+			log.Printf("%s recovered after %d failures, resuming collection", urls, b.failures)
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.open() {
+		log.Printf("%s: %d consecutive failures, next attempt in %s", urls, b.failures, b.interval)
+		b.probe = now.Add(b.interval)
+	}
+}
+
+// config is the collector's configuration, shared by every collection.
+type config struct {
+	source                     string
+	sourceTemplate             *template.Template
+	sourceCase                 string
+	sourceCount                int
+	email, token               string
+	gauges, counters           metricList
+	gaugeEach                  eachMetricList
+	matchCounts                matchCounterList
+	sums                       sumMetricList
+	countersAsGauges           bool
+	strlens                    metricList
+	edgeCounters               metricList
+	consts                     constList
+	passthrough                bool
+	prefix                     string
+	separator                  string
+	gaugeSuffix, counterSuffix string
+	jsonPaths                  map[string]*jsonpath.Path
+	embedded                   [][]string
+	coerceStrings              bool
+	skipNonNumeric             bool
+	strict                     bool
+	units                      unitList
+	transforms                 transformMap
+	dropNA                     bool
+	allow, deny                globList
+	conditions                 conditionList
+	thresholds                 thresholdList
+	sampleRate                 float64
+	bestEffort                 bool
+	failOnEmpty                bool
+	debug                      bool
+	fetchMetrics               bool
+	selfMetrics                bool
+	sequenceName               string
+	report                     bool
+	timePath                   string
+	ageMetric                  string
+	sharedTime                 bool
+	maxTimeSkew                time.Duration
+	skewAction                 string
+	staleAfter                 time.Duration
+	tagged                     bool
+	tags                       tagMap
+	tagPaths                   tagMap
+	dedupeWindow               time.Duration
+	dropUnchangedCounters      bool
+	unchangedCounterInterval   time.Duration
+	batchInterval              time.Duration
+	gaugeAggregate             string
+	counterAggregate           string
+
+	fetcher                     *http.Client
+	acceptEncoding              string
+	format                      string
+	query                       queryList
+	cookies                     cookieList
+	grpcRequest                 string
+	collectTimeout              time.Duration
+	perURLTimeout               time.Duration
+	paginatePath, paginateParam string
+	maxPages                    int
+	fetchRetries                int
+	fetchRetryStatus            map[int]bool
+
+	postConcurrency           int
+	poster                    *http.Client
+	postRetries               int
+	retryBackoff              time.Duration
+	idempotencyHeader         string
+	batchIDTag, batchIDHeader string
+	limiter                   *limiter
+	postOK                    map[int]bool
+	postMethod                string
+	postGzip                  bool
+	compressionThreshold      int
+	execSink                  string
+	sink                      sink
+	ndjsonURL                 string
+	remoteWriteURL            string
+	postHeaders               headerList
+	buffer                    *buffer
+	dump                      *buffer
+	watchdog                  *watchdog
+	vault                     *vault
+	stats                     stats
+
+	// the last value posted for each metric, across collections
+	posted map[string]posting
+
+	// each target's last source time, for -stale-after
+	sourceTimes map[string]sourceTimestamp
+
+	// the last total of each counter posted to the tagged API, for its deltas
+	totals map[string]int64
+
+	// the polls accumulated for each target, until the batch interval is up
+	accumulators map[string]*accumulator
+
+	// each -edge-counter's state for each target
+	edges map[string]*edge
+}
+
+// A posting is a metric's formatted value and when it was last posted.
+type posting struct {
+	value string
+	at    time.Time
+}
+
+// metricName returns the name a metric is posted under: its explicit name, or
+// its path's components joined by the namespace separator.
+func (c *config) metricName(m metric) string {
+	name := m.name
+	if name == "" {
+		name = strings.Replace(strings.Join(m.keys(), c.separator), jsonModifier, "", -1)
+	}
+	return c.qualify(name)
+}
+
+// qualify returns a sanitized name under the configured prefix, if any.
+func (c *config) qualify(name string) string {
+	if c.prefix != "" {
+		name = c.prefix + c.separator + name
+	}
+	return sanitize(name)
+}
+
+// suffixGauge returns a gauge's qualified name with -gauge-suffix, if any.
+func (c *config) suffixGauge(name string) string {
+	return sanitize(name + c.gaugeSuffix)
+}
+
+// suffixCounter returns a counter's qualified name with -counter-suffix, if any,
+// or with -gauge-suffix if it's posted as a gauge.
+func (c *config) suffixCounter(name string) string {
+	if c.countersAsGauges {
+		return c.suffixGauge(name)
+	}
+	return sanitize(name + c.counterSuffix)
+}
+
+// sanitize replaces any characters not allowed in Librato metric names with
+// underscores. Librato uses ':' to separate namespaces, so it's kept.
+func sanitize(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '.', r == ':', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// caseSource returns the source in lower or upper case, with -source-case,
+// since Librato treats Web1 and web1 as different sources.
+func (c *config) caseSource(source string) string {
+	switch c.sourceCase {
+	case "lower":
+		return strings.ToLower(source)
+	case "upper":
+		return strings.ToUpper(source)
+	}
+	return source
+}
+
+// sourceFor returns the given source, or the URL's host if none was given.
+func sourceFor(source, metricsURL string) string {
+	if source != "" {
+		return source
+	}
+
+	u, err := url.Parse(metricsURL)
+	if err != nil {
+		panic(err)
+	}
+	return u.Host
+}
+
+func collect(tgt *target, cfg *config) (err error) {
+	urls, source, derived := tgt.urls, tgt.source, tgt.derived
+	source = cfg.caseSource(source)
+
+	// -collect-timeout bounds the whole collection, retries included, not just
+	// each request
+	ctx := context.Background()
+	if cfg.collectTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.collectTimeout)
+		defer cancel()
+	}
+
+	started := time.Now()
+	if cfg.report {
+		tgt.report = newReport(tgt, started)
+	}
+	fetches := make([]fetchResult, len(urls))
+	posting := false
+
+	defer func() {
+		tgt.status, tgt.posted = fetches[0].status, source
+	}()
+
+	defer func() {
+		e := recover()
+		if e != nil {
+			log.Printf("panic: %v\n", e)
+			for skip := 1; ; skip++ {
+				pc, file, line, ok := runtime.Caller(skip)
+				if !ok {
+					break
+				}
+				if file[len(file)-1] == 'c' {
+					continue
+				}
+				f := runtime.FuncForPC(pc)
+				log.Printf("%s:%d %s()\n", file, line, f.Name())
+			}
+			err = fmt.Errorf("%v", e)
+
+			// the fetch metrics are still worth posting if the collection failed
+			// before anything was posted
+			if cfg.fetchMetrics && !posting {
+				b := batch{Gauges: make(map[string]gauge), Source: source}
+				cfg.addFetchMetrics(&b, fetches)
+				if perr := try(func() { postBatch(context.Background(), b, cfg) }); perr != nil {
+					log.Printf("unable to post fetch metrics: %v", perr)
+				}
+			}
+		}
+	}()
+
+	t := &tally{bestEffort: cfg.bestEffort}
+
+	metrics := make(map[string]interface{})
+	if tgt.streams != nil {
+		// a stream is only collected when it's had events since the last time
+		fresh := false
+		for _, s := range tgt.streams {
+			doc, ok := s.take()
+			merge(metrics, doc)
+			fresh = fresh || ok
+		}
+		if !fresh {
+			log.Printf("no events from %s since the last flush", strings.Join(urls, ","))
+			return nil
+		}
+	} else {
+		for i, url := range urls {
+			t.fail(fetchURL(ctx, cfg, url, metrics, &fetches[i]))
+		}
+	}
+
+	if cfg.embedded != nil {
+		decodeEmbedded(metrics, cfg.embedded)
+	}
+
+	now := time.Now()
+	jq := jsonq.NewQuery(metrics)
+	if tgt.templated {
+		s, err := renderSource(cfg.sourceTemplate, urls[0], jq)
+		if err != nil {
+			t.fail(fmt.Errorf("source: %v", err))
+		} else {
+			source, derived = cfg.caseSource(s), false
+		}
+	}
+
+	if cfg.debug {
+		debugPaths(jq, cfg)
+	}
+	if tgt.report != nil {
+		tgt.report.paths(jq, cfg)
+	}
+	// with -passthrough, the document's own source is used if the target has
+	// none
+	given := source
+	if derived && cfg.passthrough {
+		given = ""
+	}
+	batch, collected := batchMetrics(jq, strings.Join(urls, ","), given, cfg, t)
+	if batch.Source == "" {
+		batch.Source = source
+	}
+	source = batch.Source
+	if tgt.report != nil {
+		tgt.report.Source = source
+	}
+	if cfg.failOnEmpty && collected == 0 {
+		// not counting constants, since they're always there, or the fetch and
+		// self metrics, which are added later
+		t.fail(fmt.Errorf("no metrics collected"))
+	}
+	if cfg.sampleRate < 1 {
+		cfg.sample(&batch)
+	}
+	if cfg.fetchMetrics {
+		cfg.addFetchMetrics(&batch, fetches)
+	}
+	if cfg.tagged {
+		cfg.addTags(jq, &batch, t)
+	}
+	if cfg.selfMetrics {
+		cfg.addSelfMetrics(&batch, tgt)
+	}
+	if cfg.sequenceName != "" {
+		cfg.addSequence(&batch, tgt)
+	}
+	if !cfg.measureTime(strings.Join(urls, ","), jq, &batch, now, t) {
+		return t.err()
+	}
+	if cfg.batchInterval > 0 {
+		b, ok := cfg.accumulate(strings.Join(urls, ","), batch, now)
+		if !ok {
+			return t.err()
+		}
+		batch = b
+	}
+	if cfg.sharedTime && batch.MeasureTime == 0 {
+		// every chunk of the batch is stamped with when the collection started,
+		// rather than whenever Librato happens to receive it
+		batch.MeasureTime = started.Unix()
+	}
+	if cfg.batchIDTag != "" || cfg.batchIDHeader != "" {
+		cfg.identify(&batch)
+	}
+	cfg.dedupe(&batch, now)
+
+	posting = true
+	out := batch
+	if cfg.postsDeltas() {
+		out = cfg.counterDeltas(batch)
+	}
+	for _, b := range out.replicate(cfg.sourceCount) {
+		if cfg.buffer == nil {
+			postBatch(ctx, b, cfg)
+		} else if err := try(func() { postBatch(ctx, b, cfg) }); err != nil {
+			// the buffered deltas will be replayed, so they're counted
+			cfg.buffer.saveFailed(b, err, now)
+			cfg.rememberTotals(batch)
+			panic(err)
+		}
+		cfg.stats.sent(b.size())
+	}
+	cfg.rememberTotals(batch)
+	cfg.stats.observe(batch)
+	cfg.remember(batch, now)
+	if tgt.report != nil {
+		tgt.report.posted(batch)
+	}
+
+	return t.err()
+}
+
+// addSelfMetrics adds metrics about the collector itself to the batch.
+func (c *config) addSelfMetrics(b *batch, tgt *target) {
+	name := c.qualify("collector" + c.separator + "skipped_ticks")
+	if c.countersAsGauges {
+		b.Gauges[name] = gauge{Value: float64(tgt.skipped)}
+	} else {
+		b.Counters[name] = counter{Value: tgt.skipped}
+	}
+	log.Printf("  %s=%v", name, tgt.skipped)
+
+	// retries are the whole collector's, not just this target's, and a post's
+	// show up in the next collection's metrics
+	count, backoff := retries.take()
+	name = c.qualify("collector" + c.separator + "retries")
+	if c.countersAsGauges {
+		b.Gauges[name] = gauge{Value: float64(count)}
+	} else {
+		b.Counters[name] = counter{Value: count}
+	}
+	log.Printf("  %s=%v", name, count)
+
+	name = c.qualify("collector" + c.separator + "backoff_ms")
+	b.Gauges[name] = gauge{Value: float64(backoff) / float64(time.Millisecond)}
+	log.Printf("  %s=%v", name, b.Gauges[name].Value)
+}
+
+// addSequence adds a gauge which goes up by one with every collection of the
+// target, starting from zero when the collector starts, so gaps in it show
+// collections which never made it to Librato.
+func (c *config) addSequence(b *batch, tgt *target) {
+	name := c.qualify(c.sequenceName)
+	b.Gauges[name] = gauge{Value: float64(tgt.sequence)}
+	log.Printf("  %s=%v", name, tgt.sequence)
+	tgt.sequence++
+}
+
+// A fetchResult is the HTTP status and latency of fetching a URL. The status
+// is zero if no response was received.
+type fetchResult struct {
+	status  int
+	latency time.Duration
+}
+
+// addFetchMetrics adds gauges for the status and latency of each fetch. When
+// several URLs are merged, each one's gauges are named by its position.
+func (c *config) addFetchMetrics(b *batch, fetches []fetchResult) {
+	for i, f := range fetches {
+		prefix := "fetch"
+		if len(fetches) > 1 {
+			prefix += c.separator + strconv.Itoa(i+1)
+		}
+
+		status := c.qualify(prefix + c.separator + "status")
+		latency := c.qualify(prefix + c.separator + "latency_ms")
+		b.Gauges[status] = gauge{Value: float64(f.status)}
+		b.Gauges[latency] = gauge{Value: float64(f.latency) / float64(time.Millisecond)}
+		log.Printf("  %s=%v", status, f.status)
+		log.Printf("  %s=%v", latency, b.Gauges[latency].Value)
+	}
+}
+
+// A tally records the errors of a collection. Unless the collection is
+// best-effort, the first error aborts it.
+type tally struct {
+	bestEffort bool
+	errs       []string
+}
+
+// fail records a non-nil error, or panics with it if the collection isn't
+// best-effort.
+func (t *tally) fail(err error) {
+	if err == nil {
+		return
+	}
+
+	if !t.bestEffort {
+		panic(err)
+	}
+
+	log.Printf("  error: %v", err)
+	t.errs = append(t.errs, err.Error())
+}
+
+// err returns an error summarizing all the recorded errors, if any.
+func (t *tally) err() error {
+	if len(t.errs) == 0 {
+		return nil
+	}
+
+	log.Printf("%d error(s) during collection", len(t.errs))
+	return fmt.Errorf("%s", strings.Join(t.errs, "; "))
+}
+
+// try runs f, returning any panic as an error.
+func try(f func()) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			if pe, ok := e.(error); ok {
+				err = pe
+				return
+			}
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+
+	f()
+	return nil
+}
+
+func ticker(period time.Duration, immediate bool) <-chan time.Time {
+	// if we're not doing periodic collections, return a closed channel with a
+	// single time in it
+	if period == 0 {
+		c := make(chan time.Time, 1)
+		c <- time.Now()
+		close(c)
+		return c
+	}
+
+	if !immediate {
+		return time.Tick(period)
+	}
+
+	// otherwise, tick once now, and then every period
+	c := make(chan time.Time, 1)
+	c <- time.Now()
+	go func() {
+		for t := range time.Tick(period) {
+			c <- t
+		}
+	}()
+	return c
+}
+
+const (
+	// metricsEndpoint is Librato's legacy API for gauges and counters with a
+	// source.
+	metricsEndpoint = "https://metrics-api.librato.com/v1/metrics"
+
+	// measurementsEndpoint is Librato's tagged measurements API.
+	measurementsEndpoint = "https://metrics-api.librato.com/v1/measurements"
+
+	// maxMeasurements is the most measurements Librato accepts in one request.
+	maxMeasurements = 300
+)
+
+// postBatch posts the batch to Librato, split into chunks of at most
+// maxMeasurements. An empty batch isn't posted at all.
+func postBatch(ctx context.Context, b batch, cfg *config) {
+	if b.size() == 0 {
+		log.Printf("nothing to send")
+		return
+	}
+
+	postChunks(ctx, b.chunks(maxMeasurements), cfg)
+}
+
+// postChunks posts the chunks of a batch, with up to -post-concurrency in
+// flight at once. Chunks measured at different times are posted one at a time
+// instead, oldest first, since Librato may reject or misbucket a measurement
+// older than one it already has; once one fails, the later ones aren't posted.
+// It panics with a chunkError if only some of the chunks were posted.
+func postChunks(ctx context.Context, chunks []batch, cfg *config) {
+	errs := make([]error, len(chunks))
+
+	concurrency := cfg.postConcurrency
+	if !sameTime(chunks) {
+		sort.SliceStable(chunks, func(i, j int) bool {
+			return measuredAt(chunks[i]) < measuredAt(chunks[j])
+		})
+		concurrency = 1
+	}
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		if concurrency == 1 && i > 0 && errs[i-1] != nil {
+			errs[i] = fmt.Errorf("not posted after chunk %d failed", i)
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chunk batch) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			errs[i] = try(func() {
+				if err := cfg.limiter.wait(ctx, chunk.size()); err != nil {
+					panic(fmt.Errorf("not posted while waiting for -rate-limit: %v", err))
+				}
+				postChunk(ctx, chunk, cfg)
+			})
+		}(i, chunk)
+
+		// the next chunk waits for this one's error
+		if concurrency == 1 {
+			wg.Wait()
+		}
+	}
+	wg.Wait()
+
+	var failed []string
+	var unposted []batch
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, fmt.Sprintf("chunk %d: %v", i+1, err))
+			unposted = append(unposted, chunks[i])
+		}
+	}
+	if len(failed) == len(chunks) {
+		panic(fmt.Sprintf("%d of %d chunks failed: %s", len(failed), len(chunks), strings.Join(failed, "; ")))
+	}
+	if len(failed) > 0 {
+		panic(&chunkError{
+			msg:    fmt.Sprintf("%d of %d chunks failed: %s", len(failed), len(chunks), strings.Join(failed, "; ")),
+			chunks: unposted,
+		})
+	}
+}
+
+// sameTime returns true if the chunks were all measured at the same time.
+func sameTime(chunks []batch) bool {
+	for _, c := range chunks[1:] {
+		if c.MeasureTime != chunks[0].MeasureTime {
+			return false
+		}
+	}
+	return true
+}
+
+// measuredAt returns when a chunk was measured. One with no measurement time is
+// measured whenever Librato receives it, which is after any other.
+func measuredAt(b batch) int64 {
+	if b.MeasureTime == 0 {
+		return math.MaxInt64
+	}
+	return b.MeasureTime
+}
+
+// A chunkError is a batch which was partly posted, with the chunks which
+// failed.
+type chunkError struct {
+	msg    string
+	chunks []batch
+}
+
+func (e *chunkError) Error() string {
+	return e.msg
+}
+
+// postChunk sends a chunk of a batch to the sink, retrying on failure.
+func postChunk(ctx context.Context, batch batch, cfg *config) {
+	var v interface{} = batch
+	if cfg.tagged {
+		v = batch.tagged()
+	}
+
+	j, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	key := idempotencyKey(j, batch.MeasureTime)
+	body := cfg.sink.encode(batch, j)
+	err = retry(ctx, cfg.postRetries, cfg.retryBackoff, func() error {
+		return try(func() { cfg.sink.send(ctx, body, key, batch.ID, cfg) })
+	})
+	if err != nil {
+		panic(err)
+	}
+	cfg.watchdog.reset()
+
+	// the body is dumped as it was posted, without the headers and their
+	// credentials (or as JSON, with -ndjson-url or -remote-write-url)
+	if cfg.dump != nil {
+		if _, err := cfg.dump.write(j, time.Now()); err != nil {
+			log.Printf("unable to dump posted body: %v", err)
+		}
+	}
+}
+
+func postBody(ctx context.Context, endpoint string, j []byte, key, id string, cfg *config) {
+	// small bodies aren't worth compressing, and may even grow
+	body, compressed := j, false
+	if cfg.postGzip && len(j) > cfg.compressionThreshold {
+		body, compressed = gzipBody(j), true
+	}
+
+	h := make(http.Header)
+	h.Set("Content-Type", "application/json")
+	if compressed {
+		h.Set("Content-Encoding", "gzip")
+	}
+	h.Set("Authorization", basicAuth(cfg.credentials()))
+	sendPost(ctx, endpoint, body, h, key, id, cfg)
+}
+
+// sendPost posts a body to an HTTP sink with its own headers, and the
+// -post-method, -idempotency-header, -batch-id-header, and -post-header options
+// every HTTP sink shares. It panics unless the response's status is one of
+// -post-ok-status.
+func sendPost(ctx context.Context, endpoint string, body []byte, h http.Header, key, id string, cfg *config) {
+	req, err := http.NewRequestWithContext(ctx, cfg.postMethod, endpoint, bytes.NewReader(body))
+	if err != nil {
+		panic(err)
+	}
+	for name, values := range h {
+		req.Header[name] = values
+	}
+	if cfg.idempotencyHeader != "" {
+		req.Header.Set(cfg.idempotencyHeader, key)
+	}
+	if cfg.batchIDHeader != "" && id != "" {
+		req.Header.Set(cfg.batchIDHeader, id)
+	}
+	for name, values := range cfg.postHeaders {
+		req.Header[name] = values
+	}
+
+	resp, err := cfg.poster.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+
+	if !cfg.accepted(resp.StatusCode) {
+		body := bytes.NewBuffer(nil)
+		if _, err := io.Copy(body, resp.Body); err != nil {
+			panic(err)
+		}
+
+		panic(&statusError{status: resp.Status, code: resp.StatusCode, body: body.String()})
+	}
+}
+
+// accepted returns whether a post's response status means it succeeded: one of
+// -post-ok-status, or by default, any 2xx status from a sink other than
+// Librato.
+func (c *config) accepted(code int) bool {
+	if c.postOK == nil {
+		return code/100 == 2
+	}
+	return c.postOK[code]
+}
+
+// gzipBody returns the gzipped body.
+func gzipBody(j []byte) []byte {
+	buf := bytes.NewBuffer(nil)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(j); err != nil {
+		panic(err)
+	}
+	if err := w.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// idempotencyKey returns a key which is the same for every attempt to post the
+// same body at the same measurement time, so that backends which honor it can
+// discard duplicates of a retried post which actually succeeded.
+func idempotencyKey(body []byte, measureTime int64) string {
+	h := sha256.New()
+	_, _ = h.Write(body)
+	_, _ = fmt.Fprintf(h, "\n%d", measureTime)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// queryList is a set of query parameters given as key=value.
+type queryList url.Values
+
+func (q *queryList) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected key=value, got %q", v)
+	}
+
+	if *q == nil {
+		*q = make(queryList)
+	}
+	url.Values(*q).Add(v[:i], v[i+1:])
+	return nil
+}
+
+func (q *queryList) String() string {
+	return url.Values(*q).Encode()
+}
+
+// headerList is a set of HTTP headers given as "Name: Value".
+type headerList http.Header
+
+func (h *headerList) Set(v string) error {
+	i := strings.Index(v, ":")
+	if i <= 0 {
+		return fmt.Errorf("expected Name: Value, got %q", v)
+	}
+
+	if *h == nil {
+		*h = make(headerList)
+	}
+	http.Header(*h).Add(strings.TrimSpace(v[:i]), strings.TrimSpace(v[i+1:]))
+	return nil
+}
+
+func (h *headerList) String() string {
+	var s []string
+	for name, values := range *h {
+		for _, v := range values {
+			s = append(s, name+": "+v)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+// parseStatuses parses a comma-separated list of HTTP status codes.
+func parseStatuses(s string) (map[int]bool, error) {
+	statuses := make(map[int]bool)
+	for _, f := range strings.Split(s, ",") {
+		code, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || code < 100 || code > 999 {
+			return nil, fmt.Errorf("bad HTTP status %q", f)
+		}
+		statuses[code] = true
+	}
+	return statuses, nil
+}
+
+// credentials returns the Librato email and token, from Vault if it's used.
+func (c *config) credentials() (email, token string) {
+	if c.vault != nil {
+		return c.vault.credentials()
+	}
+	return c.email, c.token
+}
+
+func basicAuth(u, p string) string {
+	creds := base64.URLEncoding.EncodeToString([]byte(u + ":" + p))
+	return fmt.Sprintf("Basic %s", creds)
+}
+
+type batch struct {
+	Gauges      map[string]gauge   `json:"gauges"`
+	Counters    map[string]counter `json:"counters"`
+	Source      string             `json:"source"`
+	MeasureTime int64              `json:"measure_time,omitempty"`
+
+	// only used by the tagged measurements API, where a measurement's own tags
+	// are added to the batch's
+	Tags       map[string]string            `json:"tags,omitempty"`
+	MetricTags map[string]map[string]string `json:"metric_tags,omitempty"`
+
+	// with -batch-id-tag or -batch-id-header, the collection's ID
+	ID string `json:"-"`
+}
+
+// tagMetric adds a tag to one of the batch's measurements.
+func (b *batch) tagMetric(name, k, v string) {
+	if b.MetricTags == nil {
+		b.MetricTags = make(map[string]map[string]string)
+	}
+	if b.MetricTags[name] == nil {
+		b.MetricTags[name] = make(map[string]string)
+	}
+	b.MetricTags[name][k] = v
+}
+
+// size returns the number of measurements in the batch.
+func (b batch) size() int {
+	return len(b.Gauges) + len(b.Counters)
+}
+
+// replicate returns n copies of the batch, each with its source suffixed by
+// its position (e.g. web-0, web-1, ...). If n is one or less, it returns just
+// the batch itself.
+func (b batch) replicate(n int) []batch {
+	if n <= 1 {
+		return []batch{b}
+	}
+
+	batches := make([]batch, n)
+	for i := range batches {
+		batches[i] = b
+		batches[i].Source = fmt.Sprintf("%s-%d", b.Source, i)
+	}
+	return batches
+}
+
+// chunks splits the batch into batches of at most n measurements each, in
+// order of name, gauges first.
+func (b batch) chunks(n int) []batch {
+	newChunk := func() batch {
+		return batch{
+			Gauges:      make(map[string]gauge),
+			Counters:    make(map[string]counter),
+			Source:      b.Source,
+			MeasureTime: b.MeasureTime,
+			Tags:        b.Tags,
+			ID:          b.ID,
+		}
+	}
+
+	chunks := []batch{newChunk()}
+	add := func(f func(c batch)) {
+		c := chunks[len(chunks)-1]
+		if c.size() == n {
+			c = newChunk()
+			chunks = append(chunks, c)
+		}
+		f(c)
+	}
+
+	// each measurement's own tags go with it into its chunk
+	tags := func(c *batch, name string) {
+		if t, ok := b.MetricTags[name]; ok {
+			if c.MetricTags == nil {
+				c.MetricTags = make(map[string]map[string]string)
+			}
+			c.MetricTags[name] = t
+		}
+	}
+
+	for _, name := range b.gaugeNames() {
+		add(func(c batch) {
+			c.Gauges[name] = b.Gauges[name]
+			tags(&chunks[len(chunks)-1], name)
+		})
+	}
+
+	for _, name := range b.counterNames() {
+		add(func(c batch) {
+			c.Counters[name] = b.Counters[name]
+			tags(&chunks[len(chunks)-1], name)
+		})
+	}
+
+	return chunks
+}
+
+// gaugeNames returns the names of the batch's gauges, in order.
+func (b batch) gaugeNames() []string {
+	names := make([]string, 0, len(b.Gauges))
+	for name := range b.Gauges {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// counterNames returns the names of the batch's counters, in order.
+func (b batch) counterNames() []string {
+	names := make([]string, 0, len(b.Counters))
+	for name := range b.Counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+type gauge struct {
+	Value float64 `json:"value"`
+
+	// an aggregate gauge is posted as a summary of its samples instead, with
+	// their average as its value everywhere else
+	summary *summary
+}
+
+// gaugePrecision is the number of decimal places gauges are posted with, or -1
+// for encoding/json's formatting, which may use exponents.
+var gaugePrecision = -1
+
+func (g gauge) MarshalJSON() ([]byte, error) {
+	if g.summary != nil {
+		return withExtraFields(json.Marshal(g.summary))
+	}
+
+	type plain gauge
+	if gaugePrecision < 0 {
+		return withExtraFields(json.Marshal(plain(g)))
+	}
+
+	return withExtraFields(json.Marshal(struct {
+		plain
+		Value json.Number `json:"value"`
+	}{plain(g), json.Number(formatPosted(g.Value))}))
+}
+
+// UnmarshalJSON decodes a gauge, including an aggregate gauge, as it was
+// buffered.
+func (g *gauge) UnmarshalJSON(j []byte) error {
+	var v struct {
+		Value *float64 `json:"value"`
+		Count *int     `json:"count"`
+		summary
+	}
+	if err := json.Unmarshal(j, &v); err != nil {
+		return err
+	}
+
+	*g = gauge{}
+	if v.Value != nil {
+		g.Value = *v.Value
+	}
+	if v.Count != nil && *v.Count > 0 {
+		s := v.summary
+		s.Count = *v.Count
+		g.summary = &s
+		g.Value = s.Sum / float64(s.Count)
+	}
+	return nil
+}
+
+// formatPosted formats a gauge's value as it's posted.
+func formatPosted(v float64) string {
+	if gaugePrecision < 0 {
+		return formatGauge(v)
+	}
+	return strconv.FormatFloat(v, 'f', gaugePrecision, 64)
+}
+
+type counter struct {
+	Value int64 `json:"value"`
+}
+
+func (c counter) MarshalJSON() ([]byte, error) {
+	type plain counter
+	return withExtraFields(json.Marshal(plain(c)))
+}
+
+// batchMetrics returns a batch of the document's metrics, and how many were
+// collected from it, not counting constants.
+func batchMetrics(jq *jsonq.JsonQuery, key, source string, cfg *config, t *tally) (batch, int) {
+	b := batch{
+		Gauges:   make(map[string]gauge),
+		Counters: make(map[string]counter),
+		Source:   source,
+	}
+
+	if cfg.passthrough {
+		cfg.addPassthrough(jq, &b, t)
+	}
+
+	gauges, counters, strlens := cfg.gauges, cfg.counters, cfg.strlens
+	if cfg.jsonPaths != nil {
+		doc, _ := jq.Object()
+		gauges = cfg.expandJSONPaths(doc, gauges)
+		counters = cfg.expandJSONPaths(doc, counters)
+		strlens = cfg.expandJSONPaths(doc, strlens)
+	}
+
+	for _, m := range gauges {
+		v, err := cfg.gaugeValue(jq, m)
+		if err == errSkipped {
+			continue
+		} else if err != nil {
+			if !m.missing(jq) {
+				t.fail(fmt.Errorf("%s: %v", m.path, err))
+				continue
+			}
+			v = m.fallback()
+		}
+		name := cfg.suffixGauge(cfg.metricName(m))
+		if tr, ok := cfg.transformFor(m, name); ok {
+			v = tr.apply(v)
+		}
+		log.Printf("  %s=%v", name, v)
+		b.Gauges[name] = gauge{Value: v}
 	}
 
-	if source == "" {
-		u, err := url.Parse(metricsURL)
+	for _, m := range strlens {
+		var v float64
+		s, err := jq.String(m.keys()...)
 		if err != nil {
-			panic(err)
+			if !m.missing(jq) {
+				t.fail(fmt.Errorf("%s: %v", m.path, err))
+				continue
+			}
+			v = m.fallback()
+		} else {
+			v = float64(utf8.RuneCountInString(s))
 		}
-		source = u.Host
+		name := cfg.suffixGauge(cfg.metricName(m))
+		if tr, ok := cfg.transformFor(m, name); ok {
+			v = tr.apply(v)
+		}
+		log.Printf("  %s=%v", name, v)
+		b.Gauges[name] = gauge{Value: v}
 	}
 
-	for _ = range ticker(period) {
-		log.Printf("collecting %s", metricsURL)
-		collect(metricsURL, source, email, token, gaugePaths, counterPaths)
+	for _, m := range cfg.gaugeEach {
+		m.gauges(jq, &b, cfg, t)
 	}
-}
 
-func collect(url, source, email, token string, gaugePaths, counterPaths stringList) {
-	defer func() {
-		e := recover()
-		if e != nil {
-			log.Printf("panic: %v\n", e)
-			for skip := 1; ; skip++ {
-				pc, file, line, ok := runtime.Caller(skip)
-				if !ok {
-					break
-				}
-				if file[len(file)-1] == 'c' {
-					continue
-				}
-				f := runtime.FuncForPC(pc)
-				log.Printf("%s:%d %s()\n", file, line, f.Name())
+	for _, m := range cfg.matchCounts {
+		m.count(jq, &b, cfg, t)
+	}
+
+	for _, m := range cfg.sums {
+		m.sum(jq, &b, cfg, t)
+	}
+
+	for _, m := range counters {
+		v, err := cfg.counterValue(jq, m)
+		if err == errSkipped {
+			continue
+		} else if err != nil {
+			if !m.missing(jq) {
+				t.fail(fmt.Errorf("%s: %v", m.path, err))
+				continue
 			}
+			v = int64(m.fallback())
 		}
-	}()
+		name := cfg.suffixCounter(cfg.metricName(m))
+		if tr, ok := cfg.transformFor(m, name); ok {
+			v = int64(tr.apply(float64(v)))
+		}
+		log.Printf("  %s=%v", name, v)
+		b.Counters[name] = counter{Value: v}
+	}
+
+	if len(cfg.edgeCounters) > 0 {
+		cfg.addEdges(key, jq, &b, t)
+	}
+
+	// a metric collected under a constant's name takes its place
+	collected := b.size()
+	for _, c := range cfg.consts {
+		name := cfg.suffixGauge(cfg.qualify(c.name))
+		if _, ok := b.Gauges[name]; ok {
+			continue
+		}
+		log.Printf("  %s=%v", name, c.value)
+		b.Gauges[name] = gauge{Value: c.value}
+	}
+
+	if cfg.dropNA {
+		for name, g := range b.Gauges {
+			if math.IsNaN(g.Value) || math.IsInf(g.Value, 0) {
+				log.Printf("  %s is %v, dropping", name, g.Value)
+				delete(b.Gauges, name)
+			}
+		}
+	}
+
+	if len(cfg.allow) > 0 || len(cfg.deny) > 0 {
+		cfg.filter(&b)
+	}
+	if len(cfg.conditions) > 0 {
+		cfg.gate(jq, &b)
+	}
+	if len(cfg.thresholds) > 0 {
+		cfg.checkThresholds(b)
+	}
 
-	metrics := fetchMetrics(url)
-	batch := batchMetrics(metrics, source, gaugePaths, counterPaths)
-	postBatch(batch, email, token)
+	return b, collected
 }
 
-func ticker(period time.Duration) <-chan time.Time {
-	// if we're not doing periodic collections, return a closed channel with a
-	// single time in it
-	if period == 0 {
-		c := make(chan time.Time, 1)
-		c <- time.Now()
-		close(c)
-		return c
+// debugPaths logs whether each configured path resolved, and to what.
+func debugPaths(jq *jsonq.JsonQuery, cfg *config) {
+	var metrics []metric
+	metrics = append(metrics, cfg.gauges...)
+	metrics = append(metrics, cfg.counters...)
+	metrics = append(metrics, cfg.strlens...)
+
+	for _, m := range metrics {
+		expanded := cfg.expand(jq, m)
+		for _, e := range expanded {
+			// a JSONPath which selects several nodes is logged for each
+			path := m.path
+			if len(expanded) > 1 {
+				path += " at " + strings.Join(e.keys(), ".")
+			}
+
+			v, err := jq.Interface(e.keys()...)
+			if err != nil {
+				log.Printf("debug: %s did not resolve: %v", path, err)
+				continue
+			}
+			log.Printf("debug: %s resolved to %v (%T)", path, v, v)
+		}
 	}
-	return time.Tick(period)
 }
 
-func postBatch(batch batch, email, token string) {
-	j, err := json.Marshal(batch)
+// transformFor returns the transform configured for the metric, by either its
+// name or its path, if any.
+func (c *config) transformFor(m metric, name string) (transform, bool) {
+	t, ok := c.transforms[name]
+	if !ok {
+		t, ok = c.transforms[m.path]
+	}
+	return t, ok
+}
+
+// gaugeValue returns the value of a gauge. Integers are read as floats.
+func (c *config) gaugeValue(jq *jsonq.JsonQuery, m metric) (float64, error) {
+	v, err := jq.Interface(m.keys()...)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 
-	r := bytes.NewReader(j)
-	req, err := http.NewRequest("POST", "https://metrics-api.librato.com/v1/metrics", r)
+	v, err = c.unstring(m, v)
 	if err != nil {
-		panic(err)
+		return 0, err
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", basicAuth(email, token))
+	return 0, fmt.Errorf("expected a number, got %s", describe(v))
+}
 
-	resp, err := http.DefaultClient.Do(req)
+// counterValue returns the value of a counter. Integers are read exactly, even
+// beyond float64's 53 bits of precision. Floats are truncated, with a warning.
+func (c *config) counterValue(jq *jsonq.JsonQuery, m metric) (int64, error) {
+	v, err := jq.Interface(m.keys()...)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer func() {
-		_, _ = io.Copy(ioutil.Discard, resp.Body)
-		_ = resp.Body.Close()
-	}()
 
-	if resp.StatusCode != 200 {
-		body := bytes.NewBuffer(nil)
-		if _, err := io.Copy(body, resp.Body); err != nil {
-			panic(err)
+	v, err = c.unstring(m, v)
+	if err != nil {
+		return 0, err
+	}
+
+	if n, ok := v.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
 		}
 
-		panic(fmt.Sprintf("received %s\n\n%s\n", resp.Status, body.String()))
+		f, err := n.Float64()
+		if err != nil {
+			return 0, err
+		}
+		v = f
 	}
-}
 
-func basicAuth(u, p string) string {
-	creds := base64.URLEncoding.EncodeToString([]byte(u + ":" + p))
-	return fmt.Sprintf("Basic %s", creds)
+	switch v := v.(type) {
+	case float64:
+		if v != math.Trunc(v) || v >= math.MaxInt64 || v < math.MinInt64 {
+			if c.strict {
+				return 0, fmt.Errorf("expected an integer, got %v", v)
+			}
+			log.Printf("  warning: counter %s is %v, truncating", m.path, v)
+		}
+		return int64(v), nil
+	case int:
+		return int64(v), nil
+	}
+	return 0, fmt.Errorf("expected a number, got %s", describe(v))
 }
 
-type batch struct {
-	Gauges   map[string]gauge   `json:"gauges"`
-	Counters map[string]counter `json:"counters"`
-	Source   string             `json:"source"`
+// describe returns a value's JSON type and the value, for errors.
+func describe(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprintf("a boolean (%v)", v)
+	case string:
+		return fmt.Sprintf("a string (%q)", v)
+	case []interface{}:
+		return fmt.Sprintf("an array of %d elements", len(v))
+	case map[string]interface{}:
+		return fmt.Sprintf("an object of %d keys", len(v))
+	}
+	return fmt.Sprintf("%v", v)
 }
 
-type gauge struct {
-	Value float64 `json:"value"`
+// coerce parses a number encoded as a string, if -coerce-strings is set.
+func (c *config) coerce(m metric, s string) (json.Number, bool) {
+	if !c.coerceStrings {
+		return "", false
+	}
+
+	s = strings.TrimSpace(s)
+	if _, err := strconv.ParseFloat(s, 64); err != nil {
+		return "", false
+	}
+
+	log.Printf("  coerced %s from %q", m.path, s)
+	return json.Number(s), true
 }
 
-type counter struct {
-	Value int `json:"value"`
+// fetchOptions configure the HTTP client used to fetch metrics.
+type fetchOptions struct {
+	clientCert, clientKey string
+	maxRedirects          int
+	sameHostRedirects     bool
+	dnsCacheTTL           time.Duration
+	localAddr             *net.TCPAddr
+	http2                 bool
+	tlsMinVersion         string
+	tlsCiphers            string
+
+	oauthTokenURL                    string
+	oauthClientID, oauthClientSecret string
+	oauthScopes                      string
+
+	awsRegion, awsService      string
+	awsAccessKey, awsSecretKey string
 }
 
-func batchMetrics(jq *jsonq.JsonQuery, source string, gauges, counters []string) batch {
-	b := batch{
-		Gauges:   make(map[string]gauge),
-		Counters: make(map[string]counter),
-		Source:   source,
-	}
+// newFetchClient returns an HTTP client for fetching metrics.
+func newFetchClient(opts fetchOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
 
-	for _, path := range gauges {
-		v, err := jq.Float(strings.Split(path, ".")...)
+	tlsConfig := &tls.Config{}
+	if opts.clientCert != "" || opts.clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.clientCert, opts.clientKey)
 		if err != nil {
-			panic(err)
+			return nil, fmt.Errorf("unable to load client certificate: %v", err)
 		}
-		log.Printf("  %s=%v", path, v)
-		b.Gauges[path] = gauge{Value: v}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
-
-	for _, path := range counters {
-		v, err := jq.Int(strings.Split(path, ".")...)
+	if opts.tlsMinVersion != "" {
+		v, ok := tlsVersions[opts.tlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS version %q", opts.tlsMinVersion)
+		}
+		tlsConfig.MinVersion = v
+	}
+	if opts.tlsCiphers != "" {
+		suites, err := parseCipherSuites(opts.tlsCiphers)
 		if err != nil {
-			panic(err)
+			return nil, err
+		}
+		tlsConfig.CipherSuites = suites
+	}
+	if len(tlsConfig.Certificates) > 0 || tlsConfig.MinVersion != 0 || tlsConfig.CipherSuites != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+
+	if opts.dnsCacheTTL > 0 {
+		transport.DialContext = newDNSCache(opts.dnsCacheTTL, newDialer(opts.localAddr)).dial
+	} else {
+		transport.DialContext = newDialer(opts.localAddr).DialContext
+	}
+	setHTTP2(transport, opts.http2)
+
+	checkRedirect := func(req *http.Request, via []*http.Request) error {
+		if len(via) > opts.maxRedirects {
+			return fmt.Errorf("stopped after %d redirects", opts.maxRedirects)
+		}
+		if opts.sameHostRedirects && req.URL.Host != via[0].URL.Host {
+			return fmt.Errorf("refusing to redirect from %s to %s", via[0].URL.Host, req.URL.Host)
+		}
+		return nil
+	}
+
+	var rt http.RoundTripper = transport
+	if opts.oauthTokenURL != "" {
+		rt = &oauthTransport{
+			base:         transport,
+			tokenURL:     opts.oauthTokenURL,
+			clientID:     opts.oauthClientID,
+			clientSecret: opts.oauthClientSecret,
+			scopes:       opts.oauthScopes,
+		}
+	}
+	if opts.awsRegion != "" {
+		rt = &sigv4Transport{
+			base:      rt,
+			region:    opts.awsRegion,
+			service:   opts.awsService,
+			accessKey: opts.awsAccessKey,
+			secretKey: opts.awsSecretKey,
+		}
+	}
+
+	return &http.Client{Transport: rt, CheckRedirect: checkRedirect}, nil
+}
+
+// tlsVersions are the versions -tls-min-version accepts.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// parseCipherSuites parses a comma-separated list of cipher suite names, like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure suites must be named
+// explicitly to be allowed.
+func parseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, cs := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[cs.Name] = cs.ID
+	}
+
+	var suites []uint16
+	for _, name := range strings.Split(s, ",") {
+		id, ok := known[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
 		}
-		log.Printf("  %s=%v", path, v)
-		b.Counters[path] = counter{Value: v}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// newPostClient returns an HTTP client for posting batches.
+func newPostClient(http2 bool, local *net.TCPAddr) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newDialer(local).DialContext
+	setHTTP2(transport, http2)
+	return &http.Client{Transport: transport}
+}
+
+// newDialer returns a dialer with the same timeouts as Go's default transport,
+// and connecting from the given local address, if any.
+func newDialer(local *net.TCPAddr) *net.Dialer {
+	d := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	if local != nil {
+		d.LocalAddr = local
 	}
+	return d
+}
+
+// bindableAddr parses a local IP address to connect from, and checks that it
+// can actually be bound to, so a typo fails at startup instead of every fetch
+// and post failing later.
+func bindableAddr(ip string) (*net.TCPAddr, error) {
+	addr, err := net.ResolveTCPAddr("tcp", net.JoinHostPort(ip, "0"))
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = l.Close()
+
+	addr.Port = 0
+	return addr, nil
+}
 
-	return b
+// setHTTP2 enables or disables HTTP/2. It's attempted even with a custom TLS
+// config, like -client-cert's, which would otherwise quietly disable it.
+func setHTTP2(transport *http.Transport, enabled bool) {
+	transport.ForceAttemptHTTP2 = enabled
+	if !enabled {
+		// a non-nil, empty map is what turns HTTP/2 off entirely
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
 }
 
-func fetchMetrics(url string) *jsonq.JsonQuery {
-	resp, err := http.Get(url)
+// fetchMetrics fetches and decodes the document at the URL, recording the
+// fetch's status and latency.
+func fetchMetrics(ctx context.Context, cfg *config, metricsURL string, result *fetchResult) map[string]interface{} {
+	u, err := url.Parse(metricsURL)
+	if err != nil {
+		panic(err)
+	}
+	if len(cfg.query) > 0 {
+		q := u.Query()
+		for k, v := range cfg.query {
+			q[k] = v
+		}
+		u.RawQuery = q.Encode()
+	}
+	if u.Scheme == "grpc" || u.Scheme == "grpcs" {
+		return fetchGRPC(ctx, cfg, u, result)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		panic(err)
+	}
+	if cfg.acceptEncoding != "" {
+		req.Header.Set("Accept-Encoding", cfg.acceptEncoding)
+	}
+	for _, c := range cfg.cookies {
+		req.AddCookie(c)
+	}
+
+	// responses with a -fetch-retry-status are retried, since they mean the
+	// endpoint isn't ready yet
+	var resp *http.Response
+	err = retryIf(ctx, cfg.fetchRetries, cfg.retryBackoff, func() error {
+		start := time.Now()
+		r, err := cfg.fetcher.Do(req)
+		result.latency = time.Since(start)
+		if err != nil {
+			return err
+		}
+		result.status = r.StatusCode
+		if cfg.fetchRetryStatus[r.StatusCode] {
+			_, _ = io.Copy(ioutil.Discard, r.Body)
+			_ = r.Body.Close()
+			return &statusError{status: r.Status, code: r.StatusCode}
+		}
+		resp = r
+		return nil
+	}, func(err error) bool {
+		_, ok := err.(*statusError)
+		return ok
+	})
 	if err != nil {
 		panic(err)
 	}
@@ -185,12 +2452,108 @@ func fetchMetrics(url string) *jsonq.JsonQuery {
 		panic("received a " + resp.Status + " response")
 	}
 
-	var metrics map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+	body, err := decodeBody(resp)
+	if err != nil {
+		panic(err)
+	}
+
+	metrics, err := decodeDocument(cfg.format, body)
+	if err != nil {
 		panic(err)
 	}
 
-	return jsonq.NewQuery(metrics)
+	if cfg.debug {
+		j, err := json.MarshalIndent(metrics, "", "  ")
+		if err == nil {
+			log.Printf("debug: %s returned:\n%s", metricsURL, j)
+		}
+	}
+
+	return metrics
+}
+
+// fetchURL fetches a URL's metrics, and any more pages of them, and merges them
+// into the document. With -per-url-timeout, the fetch and decoding of each URL
+// has its own deadline within the collection's, so one slow endpoint can't
+// starve the rest of the collection.
+func fetchURL(collection context.Context, cfg *config, url string, metrics map[string]interface{}, result *fetchResult) error {
+	ctx := collection
+	if cfg.perURLTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.perURLTimeout)
+		defer cancel()
+	}
+
+	err := try(func() {
+		doc := fetchMetrics(ctx, cfg, url, result)
+		if cfg.paginatePath != "" {
+			doc = cfg.paginate(ctx, url, doc, result)
+		}
+		merge(metrics, doc)
+	})
+	if err != nil && ctx.Err() == context.DeadlineExceeded && collection.Err() == nil {
+		log.Printf("%s took longer than -per-url-timeout (%s)", url, cfg.perURLTimeout)
+	}
+	return err
+}
+
+// printPaths writes the path, value, and type of every numeric leaf in the
+// document, in order of path.
+func printPaths(w io.Writer, doc map[string]interface{}) {
+	leaves := make(map[string]string)
+	walk(doc, nil, func(path []string, v interface{}) {
+		switch v := v.(type) {
+		case json.Number:
+			if _, err := v.Int64(); err == nil {
+				leaves[strings.Join(path, ".")] = v.String() + "\tint"
+			} else {
+				leaves[strings.Join(path, ".")] = v.String() + "\tfloat"
+			}
+		case float64:
+			leaves[strings.Join(path, ".")] = formatGauge(v) + "\tfloat"
+		}
+	})
+
+	paths := make([]string, 0, len(leaves))
+	for path := range leaves {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		fmt.Fprintf(w, "%s\t%s\n", path, leaves[path])
+	}
+}
+
+// walk calls f with the path and value of every leaf in a decoded JSON value.
+// Array elements are addressed by their index.
+func walk(v interface{}, path []string, f func(path []string, v interface{})) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			walk(e, append(path[:len(path):len(path)], k), f)
+		}
+	case []interface{}:
+		for i, e := range v {
+			walk(e, append(path[:len(path):len(path)], strconv.Itoa(i)), f)
+		}
+	default:
+		f(path, v)
+	}
+}
+
+// merge recursively merges src into dst. Values in src win on conflicts, unless
+// both values are objects, in which case they're merged in turn.
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if sv, ok := v.(map[string]interface{}); ok {
+			if dv, ok := dst[k].(map[string]interface{}); ok {
+				merge(dv, sv)
+				continue
+			}
+		}
+		dst[k] = v
+	}
 }
 
 type stringList []string
@@ -203,3 +2566,136 @@ func (l *stringList) Set(v string) error {
 func (l *stringList) String() string {
 	return strings.Join(*l, ",")
 }
+
+// A metric is a JSON path to a value, an optional name to post it under instead
+// of one derived from the path, and an optional default to post if the path is
+// missing from the response.
+type metric struct {
+	path     string
+	name     string
+	def      *float64
+	segments []string
+}
+
+// parseMetric parses a metric of the form path[=name][:default].
+func parseMetric(s string) (metric, error) {
+	var m metric
+
+	// names may contain ':' namespace separators, so only a numeric suffix is
+	// taken as a default
+	spec := s
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		if v, err := strconv.ParseFloat(spec[i+1:], 64); err == nil {
+			m.def = &v
+			spec = spec[:i]
+		}
+	}
+
+	m.path = spec
+	if i := nameIndex(spec); i >= 0 {
+		m.path, m.name = spec[:i], spec[i+1:]
+	}
+
+	if m.path == "" {
+		return m, fmt.Errorf("no path in %q", s)
+	}
+	return m, nil
+}
+
+// keys returns the keys of the metric's path. A JSONPath metric which has been
+// expanded is addressed by its node's segments instead.
+func (m metric) keys() []string {
+	if m.segments != nil {
+		return m.segments
+	}
+	return strings.Split(m.path, ".")
+}
+
+// missing returns true if the metric's path is absent and it has a default.
+func (m metric) missing(jq *jsonq.JsonQuery) bool {
+	if m.def == nil {
+		return false
+	}
+	_, err := jq.Interface(m.keys()...)
+	return err != nil
+}
+
+// nameIndex returns the index of the '=' which separates a path from its name,
+// skipping any inside a JSONPath's brackets or quotes, or -1 if there's none.
+func nameIndex(spec string) int {
+	depth, quote := 0, byte(0)
+	for i := 0; i < len(spec); i++ {
+		switch c := spec[i]; {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case c == '=' && depth == 0:
+			return i
+		}
+	}
+	return -1
+}
+
+func (m metric) fallback() float64 {
+	log.Printf("  %s missing, using default of %v", m.path, *m.def)
+	return *m.def
+}
+
+type metricList []metric
+
+func (l *metricList) Set(v string) error {
+	m, err := parseMetric(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, m)
+	return nil
+}
+
+func (l *metricList) String() string {
+	s := make([]string, len(*l))
+	for i, m := range *l {
+		s[i] = m.path
+	}
+	return strings.Join(s, ",")
+}
+
+// A constant is a gauge with a fixed value, sent with every batch.
+type constant struct {
+	name  string
+	value float64
+}
+
+type constList []constant
+
+func (l *constList) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+
+	f, err := strconv.ParseFloat(v[i+1:], 64)
+	if err != nil {
+		return fmt.Errorf("bad value for %q: %v", v, err)
+	}
+
+	*l = append(*l, constant{name: v[:i], value: f})
+	return nil
+}
+
+func (l *constList) String() string {
+	s := make([]string, len(*l))
+	for i, c := range *l {
+		s[i] = fmt.Sprintf("%s=%v", c.name, c.value)
+	}
+	return strings.Join(s, ",")
+}
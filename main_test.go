@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/jsonq"
+)
+
+func TestGaugeValueAcceptsIntegers(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want float64
+	}{
+		{"integer number", json.Number("42"), 42},
+		{"float number", json.Number("2.5"), 2.5},
+		{"negative integer", json.Number("-7"), -7},
+		{"float64", float64(1.25), 1.25},
+		{"int", 3, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jq := jsonq.NewQuery(map[string]interface{}{"v": tt.v})
+			got, err := (&config{}).gaugeValue(jq, metric{path: "v"})
+			if err != nil {
+				t.Fatalf("gaugeValue() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("gaugeValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterValueAcceptsFloats(t *testing.T) {
+	tests := []struct {
+		name    string
+		v       interface{}
+		strict  bool
+		want    int64
+		wantErr bool
+	}{
+		{"integer number", json.Number("42"), false, 42, false},
+		{"float number", json.Number("2.7"), false, 2, false},
+		{"negative float number", json.Number("-2.7"), false, -2, false},
+		{"integral float number", json.Number("5.0"), false, 5, false},
+		{"float64", float64(9.9), false, 9, false},
+		{"int", 3, false, 3, false},
+		{"float with -jsonq-strict", json.Number("2.7"), true, 0, true},
+		{"string", "many", false, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jq := jsonq.NewQuery(map[string]interface{}{"v": tt.v})
+			got, err := (&config{strict: tt.strict}).counterValue(jq, metric{path: "v"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("counterValue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("counterValue() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterPrecision(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		path string
+		want int64
+	}{
+		{"2^53 + 1", `{"bytes": 9007199254740993}`, "bytes", 9007199254740993},
+		{"max int64", `{"bytes": 9223372036854775807}`, "bytes", 9223372036854775807},
+		{"nested", `{"net": {"bytes": 18014398509481985}}`, "net.bytes", 18014398509481985},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := decodeDocument("json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatalf("decodeDocument() error = %v", err)
+			}
+
+			got, err := (&config{}).counterValue(jsonq.NewQuery(doc), metric{path: tt.path})
+			if err != nil {
+				t.Fatalf("counterValue() error = %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("counterValue() = %d, want %d", got, tt.want)
+			}
+
+			// it's posted exactly, too
+			j, err := json.Marshal(batch{Counters: map[string]counter{"bytes": {Value: got}}})
+			if err != nil {
+				t.Fatalf("json.Marshal() error = %v", err)
+			}
+			if want := `"bytes":{"value":` + strconv.FormatInt(tt.want, 10) + `}`; !strings.Contains(string(j), want) {
+				t.Errorf("posted %s, want it to contain %s", j, want)
+			}
+		})
+	}
+}
+
+func TestPostChunksInTimeOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		times      []int64
+		failing    int64
+		wantPosted []int64
+		wantFailed []int64
+	}{
+		{"in order", []int64{100, 200, 300}, -1, []int64{100, 200, 300}, nil},
+		{"out of order", []int64{300, 100, 200, 0}, -1, []int64{100, 200, 300, 0}, nil},
+		{"stops at a failure", []int64{300, 100, 200}, 200, []int64{100, 200}, []int64{200, 300}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var posted []int64
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := ioutil.ReadAll(r.Body)
+				var b batch
+				if err := json.Unmarshal(body, &b); err != nil {
+					t.Errorf("unable to parse posted batch: %v", err)
+				}
+
+				// the later a chunk's time, the sooner it'd finish if they were
+				// posted at once
+				time.Sleep(time.Duration(400-b.MeasureTime%400) * 10 * time.Microsecond)
+				mu.Lock()
+				posted = append(posted, b.MeasureTime)
+				mu.Unlock()
+				if b.MeasureTime == tt.failing {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer srv.Close()
+
+			var chunks []batch
+			for _, ts := range tt.times {
+				chunks = append(chunks, batch{Gauges: map[string]gauge{"a": {Value: 1}}, Source: "web", MeasureTime: ts})
+			}
+
+			cfg := &config{
+				postMethod:      "POST",
+				postConcurrency: len(chunks),
+				poster:          http.DefaultClient,
+				sink:            libratoSink{endpoint: srv.URL},
+			}
+			err := try(func() { postChunks(context.Background(), chunks, cfg) })
+
+			if fmt.Sprint(posted) != fmt.Sprint(tt.wantPosted) {
+				t.Errorf("posted %v, want %v", posted, tt.wantPosted)
+			}
+
+			var failed []int64
+			if ce, ok := err.(*chunkError); ok {
+				for _, c := range ce.chunks {
+					failed = append(failed, c.MeasureTime)
+				}
+			} else if err != nil {
+				t.Fatalf("postChunks() error = %v, want a chunkError", err)
+			}
+			if fmt.Sprint(failed) != fmt.Sprint(tt.wantFailed) {
+				t.Errorf("failed %v, want %v", failed, tt.wantFailed)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// A matchCounter counts the objects in an array whose field matches a value,
+// such as the lines of an NDJSON event log with a given level. For example,
+// "errors=lines[].level==error" posts a counter named errors of the lines
+// whose level is "error".
+type matchCounter struct {
+	name  string
+	array string
+	field string
+	op    string // "==", "!=", or "" to count every element
+	value string
+}
+
+// parseMatchCounter parses a counter of the form name=array[], which counts
+// every element, or name=array[].field==value or name=array[].field!=value.
+func parseMatchCounter(s string) (matchCounter, error) {
+	var m matchCounter
+
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return m, fmt.Errorf("expected name=array[].field==value in %q", s)
+	}
+	m.name, s = s[:i], s[i+1:]
+
+	i = strings.Index(s, "[]")
+	if i <= 0 {
+		return m, fmt.Errorf("expected array[] in %q", s)
+	}
+	m.array, s = s[:i], s[i+2:]
+	if s == "" {
+		return m, nil
+	}
+
+	if !strings.HasPrefix(s, ".") {
+		return m, fmt.Errorf("expected array[].field in %q", s)
+	}
+	s = s[1:]
+	for _, op := range []string{"==", "!="} {
+		if i := strings.Index(s, op); i > 0 {
+			m.field, m.op, m.value = s[:i], op, s[i+len(op):]
+			return m, nil
+		}
+	}
+	return m, fmt.Errorf("expected field==value or field!=value in %q", s)
+}
+
+// matches returns true if the element matches the counter's predicate. A
+// missing field never equals anything.
+func (m matchCounter) matches(e interface{}) bool {
+	if m.op == "" {
+		return true
+	}
+
+	equal := false
+	if obj, ok := e.(map[string]interface{}); ok {
+		v, err := jsonq.NewQuery(obj).Interface(strings.Split(m.field, ".")...)
+		equal = err == nil && fmt.Sprint(v) == m.value
+	}
+	return equal == (m.op == "==")
+}
+
+// count adds a counter of the matching elements to the batch.
+func (m matchCounter) count(jq *jsonq.JsonQuery, b *batch, cfg *config, t *tally) {
+	elems, err := jq.Array(strings.Split(m.array, ".")...)
+	if err != nil {
+		t.fail(fmt.Errorf("%s: %v", m.array, err))
+		return
+	}
+
+	var n int64
+	for _, e := range elems {
+		if m.matches(e) {
+			n++
+		}
+	}
+
+	name := cfg.suffixCounter(cfg.qualify(m.name))
+	log.Printf("  %s=%v", name, n)
+	if cfg.countersAsGauges {
+		b.Gauges[name] = gauge{Value: float64(n)}
+	} else {
+		b.Counters[name] = counter{Value: n}
+	}
+}
+
+type matchCounterList []matchCounter
+
+func (l *matchCounterList) Set(v string) error {
+	m, err := parseMatchCounter(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, m)
+	return nil
+}
+
+func (l *matchCounterList) String() string {
+	s := make([]string, len(*l))
+	for i, m := range *l {
+		s[i] = m.name + "=" + m.array + "[]"
+		if m.op != "" {
+			s[i] += "." + m.field + m.op + m.value
+		}
+	}
+	return strings.Join(s, ",")
+}
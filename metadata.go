@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// metadata describes what to read from an instance metadata endpoint, once at
+// startup, to use as the default source and tags.
+type metadata struct {
+	url    string
+	source string
+	tags   tagMap
+}
+
+// apply fetches the metadata, setting the source and any tags which weren't
+// given explicitly.
+func (m metadata) apply(cfg *config) error {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(m.url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("received a %s response", resp.Status)
+	}
+
+	// numbers are kept as they're written, so an ID like 123456789 isn't tagged
+	// as 1.23456789e+08
+	doc := make(map[string]interface{})
+	dec := json.NewDecoder(resp.Body)
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return err
+	}
+	jq := jsonq.NewQuery(doc)
+
+	if m.source != "" && cfg.source == "" {
+		s, err := jq.String(strings.Split(m.source, ".")...)
+		if err != nil {
+			return fmt.Errorf("source: %s: %v", m.source, err)
+		}
+		log.Printf("metadata: source=%s", s)
+		cfg.source = s
+	}
+
+	for k, path := range m.tags {
+		if _, ok := cfg.tags[k]; ok {
+			continue
+		}
+
+		v, err := jq.Interface(strings.Split(path, ".")...)
+		if err != nil {
+			return fmt.Errorf("tag %s: %s: %v", k, path, err)
+		}
+
+		if cfg.tags == nil {
+			cfg.tags = make(tagMap)
+		}
+		cfg.tags[k] = fmt.Sprint(v)
+		log.Printf("metadata: tag %s=%s", k, cfg.tags[k])
+	}
+
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// An ndjsonMeasurement is one line of an -ndjson-url post.
+type ndjsonMeasurement struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Value  json.Number       `json:"value"`
+	Source string            `json:"source"`
+	Time   int64             `json:"time,omitempty"`
+	Tags   map[string]string `json:"tags,omitempty"`
+
+	// with -gauge-aggregate summary, a gauge's value is its samples' average,
+	// and their summary's fields are included alongside it
+	*summary
+}
+
+// ndjsonBody returns the batch as newline-delimited JSON, with one
+// self-contained measurement per line.
+func ndjsonBody(b batch) []byte {
+	buf := bytes.NewBuffer(nil)
+	enc := json.NewEncoder(buf)
+	write := func(m ndjsonMeasurement) {
+		m.Source, m.Time, m.Tags = b.Source, b.MeasureTime, b.Tags
+		if err := enc.Encode(m); err != nil {
+			panic(err)
+		}
+	}
+
+	for _, name := range b.gaugeNames() {
+		g := b.Gauges[name]
+		write(ndjsonMeasurement{Name: name, Type: "gauge", Value: json.Number(formatPosted(g.Value)), summary: g.summary})
+	}
+	for _, name := range b.counterNames() {
+		write(ndjsonMeasurement{Name: name, Type: "counter", Value: json.Number(formatCounter(b.Counters[name].Value))})
+	}
+	return buf.Bytes()
+}
+
+// An ndjsonSink posts batches' measurements to an HTTP endpoint as
+// newline-delimited JSON, without Librato's credentials.
+type ndjsonSink struct {
+	url string
+}
+
+func (s ndjsonSink) encode(b batch, j []byte) []byte {
+	return ndjsonBody(b)
+}
+
+func (s ndjsonSink) send(ctx context.Context, body []byte, key, id string, cfg *config) {
+	h := make(http.Header)
+	h.Set("Content-Type", "application/x-ndjson")
+	sendPost(ctx, s.url, body, h, key, id, cfg)
+}
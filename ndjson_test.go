@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNDJSONBody(t *testing.T) {
+	b := batch{
+		Gauges: map[string]gauge{
+			"heap":  {Value: 2},
+			"queue": {Value: 2, summary: summarize([]float64{1, 3})},
+		},
+		Counters: map[string]counter{"requests": {Value: 7}},
+		Source:   "web",
+	}
+	lines := strings.Split(strings.TrimSpace(string(ndjsonBody(b))), "\n")
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"gauge", `{"name":"heap","type":"gauge","value":2,"source":"web"}`},
+		{"aggregate gauge", `{"name":"queue","type":"gauge","value":2,"source":"web","count":2,"sum":4,"min":1,"max":3,"sum_squares":10}`},
+		{"counter", `{"name":"requests","type":"counter","value":7,"source":"web"}`},
+	}
+	if len(lines) != len(tests) {
+		t.Fatalf("posted %d lines, want %d:\n%s", len(lines), len(tests), strings.Join(lines, "\n"))
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if lines[i] != tt.want {
+				t.Errorf("posted %s, want %s", lines[i], tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An oauthTransport authenticates requests with an access token from an OAuth2
+// client credentials grant. The token is cached and replaced shortly before it
+// expires, or once it's been rejected.
+type oauthTransport struct {
+	base                   http.RoundTripper
+	tokenURL               string
+	clientID, clientSecret string
+	scopes                 string
+
+	sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func (t *oauthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.accessToken()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get an OAuth2 token: %v", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := t.base.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		t.Lock()
+		if t.token == token {
+			t.token = ""
+		}
+		t.Unlock()
+	}
+	return resp, err
+}
+
+// accessToken returns the cached access token, requesting a new one if it's
+// missing or about to expire.
+func (t *oauthTransport) accessToken() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if t.token != "" && (t.expiry.IsZero() || now.Before(t.expiry)) {
+		return t.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if t.scopes != "" {
+		form.Set("scope", t.scopes)
+	}
+	req, err := http.NewRequest("POST", t.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(t.clientID), url.QueryEscape(t.clientSecret))
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("received a %s response", resp.Status)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.AccessToken == "" {
+		return "", fmt.Errorf("no access_token in response")
+	}
+
+	// refresh a minute before it expires, or halfway through its lifetime if
+	// it's short; a token with no expiry is used until it's rejected
+	t.token, t.expiry = body.AccessToken, time.Time{}
+	redactSecrets(t.token)
+	if body.ExpiresIn > 0 {
+		lifetime := time.Duration(body.ExpiresIn) * time.Second
+		early := time.Minute
+		if lifetime/2 < early {
+			early = lifetime / 2
+		}
+		t.expiry = now.Add(lifetime - early)
+	}
+	return t.token, nil
+}
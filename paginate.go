@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// paginate fetches the pages after the first, following the next page's URL or
+// cursor at -paginate-path until there's none, and merges them into the
+// first. Arrays are concatenated, so metrics over a list's elements, like
+// -count-matches, count across every page. At most -max-pages are fetched, in
+// case an endpoint never stops returning a next page.
+func (c *config) paginate(ctx context.Context, first string, doc map[string]interface{}, result *fetchResult) map[string]interface{} {
+	seen := map[string]bool{first: true}
+	current, last := first, doc
+	for page := 1; ; page++ {
+		next, ok := c.nextPage(current, last)
+		if !ok {
+			return doc
+		}
+		if seen[next] {
+			log.Printf("  %s links back to %s, stopping", current, next)
+			return doc
+		}
+		if page >= c.maxPages {
+			log.Printf("  stopped after -max-pages (%d) of %s", c.maxPages, first)
+			return doc
+		}
+		seen[next] = true
+
+		var r fetchResult
+		p := fetchMetrics(ctx, c, next, &r)
+		result.status = r.status
+		result.latency += r.latency
+		for k := range p {
+			doc[k] = concat(doc[k], p[k])
+		}
+		current, last = next, p
+	}
+}
+
+// nextPage returns the URL of the page after the given one. The value at
+// -paginate-path is either a URL, which may be relative, or a cursor, which
+// is sent as the -paginate-param query parameter.
+func (c *config) nextPage(current string, page map[string]interface{}) (string, bool) {
+	v, err := jsonq.NewQuery(page).Interface(strings.Split(c.paginatePath, ".")...)
+	if err != nil || v == nil {
+		return "", false
+	}
+
+	var next string
+	switch v := v.(type) {
+	case string:
+		next = v
+	case json.Number:
+		next = v.String()
+	default:
+		log.Printf("  %s is a %T, not a URL or cursor", c.paginatePath, v)
+		return "", false
+	}
+	if next == "" {
+		return "", false
+	}
+
+	base, err := url.Parse(current)
+	if err != nil {
+		panic(err)
+	}
+	if strings.Contains(next, "://") || strings.HasPrefix(next, "/") || strings.HasPrefix(next, "?") {
+		u, err := base.Parse(next)
+		if err != nil {
+			panic(fmt.Errorf("bad next page %q: %v", next, err))
+		}
+		return u.String(), true
+	}
+
+	q := base.Query()
+	q.Set(c.paginateParam, next)
+	base.RawQuery = q.Encode()
+	return base.String(), true
+}
+
+// concat merges two pages' values, concatenating arrays and merging objects
+// in the same way. Otherwise, the later page's value wins.
+func concat(a, b interface{}) interface{} {
+	switch bv := b.(type) {
+	case []interface{}:
+		if av, ok := a.([]interface{}); ok {
+			return append(av, bv...)
+		}
+	case map[string]interface{}:
+		if av, ok := a.(map[string]interface{}); ok {
+			for k := range bv {
+				av[k] = concat(av[k], bv[k])
+			}
+			return av
+		}
+	}
+	return b
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// addPassthrough adds the gauges and counters of a document which is already a
+// Librato batch, like {"gauges": {"name": {"value": 1}}}, to the batch, so
+// the collector can relay another service's batches. Measurements may be an
+// object of names to measurements or, as in Librato's own API, an array of
+// measurements with names. The document's source is kept unless the target
+// has one of its own, and its measure_time unless -time-path says otherwise;
+// any per-measurement sources are ignored. Counters are posted as gauges with
+// -counters-as-gauges, like any others.
+func (c *config) addPassthrough(jq *jsonq.JsonQuery, b *batch, t *tally) {
+	doc, err := jq.Object()
+	if err != nil {
+		t.fail(fmt.Errorf("passthrough: %v", err))
+		return
+	}
+
+	_, hasGauges := doc["gauges"]
+	_, hasCounters := doc["counters"]
+	if !hasGauges && !hasCounters {
+		t.fail(fmt.Errorf("passthrough: expected a Librato batch, with gauges or counters"))
+		return
+	}
+
+	if s, ok := doc["source"].(string); ok && s != "" && b.Source == "" {
+		b.Source = c.caseSource(s)
+	}
+	if n, ok := doc["measure_time"].(json.Number); ok && c.timePath == "" {
+		if ts, err := n.Int64(); err == nil {
+			b.MeasureTime = ts
+		}
+	}
+
+	gauges, err := passthroughValues(doc["gauges"])
+	if err != nil {
+		t.fail(fmt.Errorf("passthrough: gauges: %v", err))
+	}
+	for _, name := range sortedKeys(gauges) {
+		f, err := gauges[name].Float64()
+		if err != nil {
+			t.fail(fmt.Errorf("passthrough: gauges: %s: %v", name, err))
+			continue
+		}
+		name := c.suffixGauge(c.qualify(name))
+		log.Printf("  %s=%v", name, f)
+		b.Gauges[name] = gauge{Value: f}
+	}
+
+	counters, err := passthroughValues(doc["counters"])
+	if err != nil {
+		t.fail(fmt.Errorf("passthrough: counters: %v", err))
+	}
+	for _, name := range sortedKeys(counters) {
+		i, err := counters[name].Int64()
+		if err != nil {
+			t.fail(fmt.Errorf("passthrough: counters: %s: expected an integer, got %s", name, counters[name]))
+			continue
+		}
+		name := c.suffixCounter(c.qualify(name))
+		log.Printf("  %s=%v", name, i)
+		if c.countersAsGauges {
+			b.Gauges[name] = gauge{Value: float64(i)}
+		} else {
+			b.Counters[name] = counter{Value: i}
+		}
+	}
+}
+
+// passthroughValues returns the values of a batch's gauges or counters, given
+// as an object of names to measurements or an array of named measurements.
+func passthroughValues(v interface{}) (map[string]json.Number, error) {
+	values := make(map[string]json.Number)
+	switch v := v.(type) {
+	case nil:
+	case map[string]interface{}:
+		for name, m := range v {
+			n, err := measurementValue(m)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			values[name] = n
+		}
+	case []interface{}:
+		for i, m := range v {
+			obj, _ := m.(map[string]interface{})
+			name, ok := obj["name"].(string)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("%d: expected a measurement with a name, got %s", i, describe(m))
+			}
+			n, err := measurementValue(m)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			values[name] = n
+		}
+	default:
+		return nil, fmt.Errorf("expected an object or an array, got %s", describe(v))
+	}
+	return values, nil
+}
+
+// measurementValue returns a measurement's value, from {"value": n}.
+func measurementValue(m interface{}) (json.Number, error) {
+	obj, ok := m.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf(`expected {"value": ...}, got %s`, describe(m))
+	}
+	switch n := obj["value"].(type) {
+	case json.Number:
+		return n, nil
+	case float64:
+		return json.Number(strconv.FormatFloat(n, 'g', -1, 64)), nil
+	}
+	return "", fmt.Errorf("expected a numeric value, got %s", describe(obj["value"]))
+}
+
+func sortedKeys(m map[string]json.Number) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
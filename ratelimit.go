@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A limiter is a token bucket which limits the rate at which measurements are
+// posted, holding up to a second's worth of tokens.
+type limiter struct {
+	sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// wait takes n tokens, blocking until the bucket has refilled enough to cover
+// them or the context is done, in which case the tokens are given back. A nil
+// limiter never blocks.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	if l == nil {
+		return nil
+	}
+
+	l.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.Lock()
+		l.tokens += float64(n)
+		l.Unlock()
+		return ctx.Err()
+	}
+}
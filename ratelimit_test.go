@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		n       int
+		timeout time.Duration
+		wantErr error
+	}{
+		{"within the bucket", 10, time.Second, nil},
+		{"short wait", 12, time.Second, nil},
+		{"canceled", 1000, 20 * time.Millisecond, context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(10)
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := l.wait(ctx, tt.n)
+			if err != tt.wantErr {
+				t.Fatalf("wait() error = %v, want %v", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > tt.timeout+100*time.Millisecond {
+				t.Errorf("wait() took %s, past its context's %s", elapsed, tt.timeout)
+			}
+
+			// a canceled wait gives its tokens back
+			if err != nil && l.tokens < 0 {
+				t.Errorf("tokens = %v after a canceled wait", l.tokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// secrets holds the credentials which -redact keeps out of the logs, and
+// redactions replaces them. Credentials read from Vault, OAuth2 access tokens,
+// and -login-url's session cookies are added as they're obtained, so both are
+// guarded by redactLock.
+var (
+	redacting  bool
+	redactLock sync.Mutex
+	secrets    []string
+	redactions *strings.Replacer
+)
+
+// redactSecrets adds credentials to be redacted from the logs, and from
+// anything else passed through redact, if -redact is on.
+func redactSecrets(s ...string) {
+	if !redacting {
+		return
+	}
+
+	redactLock.Lock()
+	defer redactLock.Unlock()
+
+	for _, v := range s {
+		if v != "" && !contains(secrets, v) {
+			secrets = append(secrets, v)
+		}
+	}
+
+	// longer secrets first, so one containing another is redacted whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	var pairs []string
+	for _, v := range secrets {
+		pairs = append(pairs, v, "[REDACTED]")
+	}
+	redactions = strings.NewReplacer(pairs...)
+}
+
+// stderr is where main reports errors on startup, redacted like the logs.
+var stderr io.Writer = redactWriter{os.Stderr}
+
+// urlSecrets returns the passwords embedded in URLs, both as they're written
+// and decoded. A URL which doesn't parse, and is about to be reported as bad,
+// may still have one.
+func urlSecrets(urls []string) []string {
+	var s []string
+	for _, v := range urls {
+		if p, ok := rawPassword(v); ok {
+			s = append(s, p)
+		}
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if p, ok := u.User.Password(); ok {
+				s = append(s, p)
+			}
+		}
+	}
+	return s
+}
+
+// rawPassword returns the password in a URL's user info, as it's written.
+func rawPassword(v string) (string, bool) {
+	i := strings.Index(v, "://")
+	if i < 0 {
+		return "", false
+	}
+	authority := v[i+3:]
+	if j := strings.IndexAny(authority, "/?#"); j >= 0 {
+		authority = authority[:j]
+	}
+	if j := strings.LastIndex(authority, "@"); j >= 0 {
+		userinfo := authority[:j]
+		if k := strings.Index(userinfo, ":"); k >= 0 && k+1 < len(userinfo) {
+			return userinfo[k+1:], true
+		}
+	}
+	return "", false
+}
+
+// headerSecrets returns the values of any -post-header which carries
+// credentials.
+func headerSecrets(h headerList) []string {
+	var s []string
+	for _, name := range []string{"Authorization", "Proxy-Authorization", "X-Api-Key"} {
+		if v := http.Header(h).Get(name); v != "" {
+			s = append(s, v)
+		}
+	}
+	return s
+}
+
+// redact replaces any secrets in s.
+func redact(s string) string {
+	redactLock.Lock()
+	r := redactions
+	redactLock.Unlock()
+
+	if r == nil {
+		return s
+	}
+	return r.Replace(s)
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// A redactWriter redacts secrets from everything written through it. The log
+// package writes each entry in a single call, so a secret is never split.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
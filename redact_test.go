@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFailuresAreRedacted(t *testing.T) {
+	const (
+		email        = "ops@example.com"
+		token        = "t0ps3cr3t-token"
+		apiKey       = "k3y-for-the-sink"
+		password     = "hunter2-password"
+		clientSecret = "cl13nt-s3cr3t"
+		accessToken  = "acc3ss-t0ken-from-oauth"
+		session      = "s3ss10n-cookie-value"
+	)
+	auth := strings.TrimPrefix(basicAuth(email, token), "Basic ")
+	all := []string{email, token, auth, apiKey, password, clientSecret, accessToken, session}
+
+	// the server echoes back the request's credentials, as some error pages do
+	echo := func(r *http.Request) string {
+		user, pass, _ := r.BasicAuth()
+		return fmt.Sprintf("%s %s:%s %s %s %s", r.URL, user, pass, r.Header.Get("Authorization"), r.Header.Get("X-Api-Key"), r.Header.Get("Cookie"))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/post", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprint(w, echo(r))
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]string{"echo": echo(r)})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"access_token": %q, "expires_in": 3600}`, accessToken)
+	})
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: session})
+		w.WriteHeader(http.StatusForbidden)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	metricsURL := strings.Replace(srv.URL, "http://", "http://user:"+password+"@", 1) + "/metrics"
+
+	// only what's known at startup is redacted up front; the rest is added as
+	// it's obtained
+	var out bytes.Buffer
+	redacting, secrets, redactions = true, nil, nil
+	redactSecrets(email, token, auth, clientSecret)
+	redactSecrets(headerSecrets(headerList{"X-Api-Key": {apiKey}})...)
+	redactSecrets(urlSecrets([]string{metricsURL})...)
+	log.SetOutput(redactWriter{&out})
+	stderr = redactWriter{&out}
+	defer func() {
+		redacting, secrets, redactions = false, nil, nil
+		log.SetOutput(os.Stderr)
+		stderr = redactWriter{os.Stderr}
+	}()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config{
+		email:           email,
+		token:           token,
+		format:          "json",
+		debug:           true,
+		postHeaders:     headerList{"X-Api-Key": {apiKey}},
+		postMethod:      "POST",
+		postRetries:     1,
+		retryBackoff:    time.Millisecond,
+		postConcurrency: 1,
+		poster:          http.DefaultClient,
+		fetcher:         &http.Client{Jar: jar},
+		sink:            libratoSink{endpoint: srv.URL + "/post"},
+	}
+
+	tests := []struct {
+		name string
+		run  func()
+	}{
+		{"post", func() {
+			b := batch{Gauges: map[string]gauge{"heap": {Value: 1}}, Source: "web"}
+			log.Printf("panic: %v", try(func() { postBatch(context.Background(), b, cfg) }))
+		}},
+		{"fetch", func() {
+			log.Printf("collecting %s", metricsURL)
+			fetchMetrics(context.Background(), cfg, metricsURL, &fetchResult{})
+		}},
+		{"OAuth2 token", func() {
+			fetcher := cfg.fetcher
+			defer func() { cfg.fetcher = fetcher }()
+			cfg.fetcher = &http.Client{Transport: &oauthTransport{
+				base:         http.DefaultTransport,
+				tokenURL:     srv.URL + "/token",
+				clientID:     "collector",
+				clientSecret: clientSecret,
+			}}
+			fetchMetrics(context.Background(), cfg, srv.URL+"/metrics", &fetchResult{})
+		}},
+		{"login cookies", func() {
+			if err := login(cfg, srv.URL+"/login"); err != nil {
+				log.Printf("unable to log in: %v", err)
+			}
+			fetchMetrics(context.Background(), cfg, srv.URL+"/metrics", &fetchResult{})
+		}},
+		{"unparseable URL", func() {
+			bad := strings.Replace(metricsURL, "/metrics", ":port/metrics", 1)
+			redactSecrets(urlSecrets([]string{bad})...)
+			fmt.Fprintln(stderr, try(func() { sourceFor("", bad) }))
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out.Reset()
+			tt.run()
+
+			logged := out.String()
+			if !strings.Contains(logged, "[REDACTED]") {
+				t.Errorf("expected credentials to be logged and redacted:\n%s", logged)
+			}
+			for _, secret := range all {
+				if strings.Contains(logged, secret) {
+					t.Errorf("logged %q:\n%s", secret, logged)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/snappy"
+)
+
+// remoteWriteBody returns the batch as a snappy-compressed Prometheus
+// remote-write request. Each gauge and counter is a series named for it, with
+// the source and the batch's and measurement's tags as labels. An aggregate
+// gauge's sample is its average, as with -tagged.
+func remoteWriteBody(b batch, now time.Time) []byte {
+	ts := now.UnixNano() / int64(time.Millisecond)
+	if b.MeasureTime != 0 {
+		ts = b.MeasureTime * 1000
+	}
+
+	var req []byte
+	for _, name := range b.gaugeNames() {
+		req = appendBytes(req, 1, b.series(name, b.Gauges[name].Value, ts))
+	}
+	for _, name := range b.counterNames() {
+		req = appendBytes(req, 1, b.series(name, float64(b.Counters[name].Value), ts))
+	}
+	return snappy.Encode(nil, req)
+}
+
+// series returns an encoded TimeSeries of one sample.
+func (b batch) series(name string, value float64, ts int64) []byte {
+	labels := map[string]string{"source": b.Source}
+	for k, v := range b.Tags {
+		labels[promName(k, false)] = v
+	}
+	for k, v := range b.MetricTags[name] {
+		labels[promName(k, false)] = v
+	}
+	labels["__name__"] = promName(name, true)
+
+	// labels must be sorted by name
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var s []byte
+	for _, k := range names {
+		var l []byte
+		l = appendBytes(l, 1, []byte(k))
+		l = appendBytes(l, 2, []byte(labels[k]))
+		s = appendBytes(s, 1, l)
+	}
+
+	var sample []byte
+	sample = binary.AppendUvarint(sample, 1<<3|1)
+	sample = binary.LittleEndian.AppendUint64(sample, math.Float64bits(value))
+	sample = binary.AppendUvarint(sample, 2<<3)
+	sample = binary.AppendUvarint(sample, uint64(ts))
+	return appendBytes(s, 2, sample)
+}
+
+// promName replaces the characters Prometheus doesn't allow in metric (which
+// may have colons) or label names with underscores.
+func promName(s string, metric bool) string {
+	var b strings.Builder
+	for i, c := range s {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '_' ||
+			(c >= '0' && c <= '9' && i > 0) || (c == ':' && metric) {
+			b.WriteRune(c)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// appendBytes appends a length-delimited protobuf field.
+func appendBytes(b []byte, field uint64, v []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// A remoteWriteSink posts batches to a Prometheus remote-write endpoint,
+// without Librato's credentials.
+type remoteWriteSink struct {
+	url string
+}
+
+func (s remoteWriteSink) encode(b batch, j []byte) []byte {
+	return remoteWriteBody(b, time.Now())
+}
+
+func (s remoteWriteSink) send(ctx context.Context, body []byte, key, id string, cfg *config) {
+	h := make(http.Header)
+	h.Set("Content-Type", "application/x-protobuf")
+	h.Set("Content-Encoding", "snappy")
+	h.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	sendPost(ctx, s.url, body, h, key, id, cfg)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"time"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// A report describes a collection, for -report-json.
+type report struct {
+	URLs     []string               `json:"urls"`
+	Source   string                 `json:"source"`
+	Started  time.Time              `json:"started"`
+	Duration float64                `json:"duration_seconds"`
+	Resolved []string               `json:"resolved"`
+	Missing  []string               `json:"missing"`
+	Gauges   map[string]json.Number `json:"gauges"`
+	Counters map[string]json.Number `json:"counters"`
+	Posted   bool                   `json:"posted"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+func newReport(tgt *target, started time.Time) *report {
+	return &report{
+		URLs:     tgt.urls,
+		Source:   tgt.source,
+		Started:  started,
+		Resolved: []string{},
+		Missing:  []string{},
+		Gauges:   make(map[string]json.Number),
+		Counters: make(map[string]json.Number),
+	}
+}
+
+// paths records which of the configured paths resolved in the document. A
+// JSONPath resolves if any node it selects does.
+func (r *report) paths(jq *jsonq.JsonQuery, cfg *config) {
+	var metrics []metric
+	metrics = append(metrics, cfg.gauges...)
+	metrics = append(metrics, cfg.counters...)
+	metrics = append(metrics, cfg.strlens...)
+
+	for _, m := range metrics {
+		resolved := false
+		for _, e := range cfg.expand(jq, m) {
+			if _, err := jq.Interface(e.keys()...); err == nil {
+				resolved = true
+			}
+		}
+
+		if resolved {
+			r.Resolved = append(r.Resolved, m.path)
+		} else {
+			r.Missing = append(r.Missing, m.path)
+		}
+	}
+}
+
+// posted records the batch's values as posted.
+func (r *report) posted(b batch) {
+	r.Posted = true
+	r.Source = b.Source
+	for name, g := range b.Gauges {
+		if !math.IsNaN(g.Value) && !math.IsInf(g.Value, 0) {
+			r.Gauges[name] = json.Number(formatPosted(g.Value))
+		}
+	}
+	for name, c := range b.Counters {
+		r.Counters[name] = json.Number(formatCounter(c.Value))
+	}
+}
+
+// write writes the report to the file, either replacing it or, with -report-
+// append, adding it as a line of its own.
+func (r *report) write(name string, appending bool, err error, finished time.Time) error {
+	r.Duration = finished.Sub(r.Started).Seconds()
+	if err != nil {
+		r.Error = redact(err.Error())
+	}
+
+	j, jerr := json.Marshal(r)
+	if jerr != nil {
+		return jerr
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if appending {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	f, ferr := os.OpenFile(name, flags, 0644)
+	if ferr != nil {
+		return ferr
+	}
+	if _, werr := f.Write(append(j, '\n')); werr != nil {
+		_ = f.Close()
+		return werr
+	}
+	return f.Close()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A statusError is an unexpected HTTP response.
+type statusError struct {
+	status string
+	code   int
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("received %s\n\n%s\n", e.status, e.body)
+}
+
+// retry calls f until it succeeds, it returns an error which isn't worth
+// retrying, it's been retried n times, or the context is done. The backoff
+// doubles after each attempt.
+func retry(ctx context.Context, n int, backoff time.Duration, f func() error) error {
+	return retryIf(ctx, n, backoff, f, retryable)
+}
+
+// retryIf is retry, but with ok deciding which errors are worth retrying.
+func retryIf(ctx context.Context, n int, backoff time.Duration, f func() error, ok func(error) bool) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= n || !ok(err) || ctx.Err() != nil {
+			return err
+		}
+
+		log.Printf("  attempt %d failed, retrying in %s: %v", attempt+1, backoff, err)
+		retries.record(backoff)
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("%v (not retried: %v)", err, ctx.Err())
+		}
+		backoff *= 2
+	}
+}
+
+// retries counts every retry of a fetch or post, across all targets, for
+// -self-metrics.
+var retries retryStats
+
+type retryStats struct {
+	sync.Mutex
+	count   int64         // since the collector started
+	backoff time.Duration // since the last time it was taken
+}
+
+func (s *retryStats) record(backoff time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.count++
+	s.backoff += backoff
+}
+
+// take returns the number of retries so far, and the time spent backing off
+// since the last call.
+func (s *retryStats) take() (int64, time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+
+	backoff := s.backoff
+	s.backoff = 0
+	return s.count, backoff
+}
+
+// retryable returns true unless the error is a response which won't change if
+// it's retried, like a 400.
+func retryable(err error) bool {
+	if se, ok := err.(*statusError); ok {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+	return true
+}
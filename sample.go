@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// sampler decides which measurements -sample-rate keeps. Collections never
+// overlap, so it's only used by one goroutine at a time.
+var sampler = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// sample keeps each of the batch's measurements with a probability of
+// -sample-rate, scaling the counters it keeps by the inverse of the rate so
+// their totals are right on average.
+func (c *config) sample(b *batch) {
+	for name := range b.Gauges {
+		if sampler.Float64() >= c.sampleRate {
+			log.Printf("  %s not sampled", name)
+			delete(b.Gauges, name)
+		}
+	}
+
+	for name, v := range b.Counters {
+		if sampler.Float64() >= c.sampleRate {
+			log.Printf("  %s not sampled", name)
+			delete(b.Counters, name)
+			continue
+		}
+		v.Value = int64(math.Round(float64(v.Value) / c.sampleRate))
+		b.Counters[name] = v
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// pollSignals trigger an immediate collection in periodic mode.
+var pollSignals = []os.Signal{syscall.SIGUSR1}
+
+// reloadSignals re-read the -config file in periodic mode.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// pollSignals trigger an immediate collection in periodic mode. Windows has no
+// SIGUSR1, so there are none.
+var pollSignals []os.Signal
+
+// reloadSignals re-read the -config file in periodic mode. Windows has no
+// SIGHUP, so there are none, and the file is only read at startup.
+var reloadSignals []os.Signal
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A sigv4Transport signs requests with AWS Signature Version 4. Without an
+// access key, the credentials come from the AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and AWS_SESSION_TOKEN environment variables, or else
+// the EC2 instance's role, which are cached until shortly before they expire.
+type sigv4Transport struct {
+	base                 http.RoundTripper
+	region, service      string
+	accessKey, secretKey string
+
+	sync.Mutex
+	creds awsCredentials
+}
+
+// awsCredentials are the keys requests are signed with.
+type awsCredentials struct {
+	accessKey, secretKey, sessionToken string
+	expiry                             time.Time
+}
+
+// imdsURL is the EC2 instance metadata service.
+var imdsURL = "http://169.254.169.254/latest"
+
+// imdsClient fetches instance credentials directly, rather than through the
+// fetch client's transport, which may add an OAuth2 token that a metadata
+// request mustn't carry, or send it through a proxy.
+var imdsClient = &http.Client{Transport: &http.Transport{}, Timeout: 5 * time.Second}
+
+func (t *sigv4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	creds, err := t.credentials()
+	if err != nil {
+		return nil, fmt.Errorf("unable to get AWS credentials: %v", err)
+	}
+
+	var body []byte
+	if req.GetBody != nil {
+		r, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, err = ioutil.ReadAll(r)
+		_ = r.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req = req.Clone(req.Context())
+	t.sign(req, body, creds, time.Now())
+	return t.base.RoundTrip(req)
+}
+
+// sign adds the X-Amz-* and Authorization headers to the request.
+func (t *sigv4Transport) sign(req *http.Request, body []byte, creds awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	payload := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+	t.authorize(req, payload, creds, now)
+}
+
+// authorize adds the Authorization header to a request which has its X-Amz-*
+// headers, signing them, the host, and the payload's hash.
+func (t *sigv4Transport) authorize(req *http.Request, payload string, creds awsCredentials, now time.Time) {
+	now = now.UTC()
+	date := now.Format("20060102")
+	amzDate := now.Format("20060102T150405Z")
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if (req.URL.Scheme == "https" && strings.HasSuffix(host, ":443")) ||
+		(req.URL.Scheme == "http" && strings.HasSuffix(host, ":80")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+
+	// only the host and the X-Amz-* headers are signed, since anything else
+	// might be changed on the way
+	headers := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		canonicalPath(req.URL, t.service),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payload,
+	}, "\n")
+
+	scope := strings.Join([]string{date, t.region, t.service, "aws4_request"}, "/")
+	toSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonical)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretKey), date)
+	for _, s := range []string{t.region, t.service, "aws4_request"} {
+		key = hmacSHA256(key, s)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKey, scope, signedHeaders, signature))
+}
+
+// credentials returns the keys to sign with: the configured ones, the
+// environment's, or the instance role's.
+func (t *sigv4Transport) credentials() (awsCredentials, error) {
+	if t.accessKey != "" {
+		return awsCredentials{accessKey: t.accessKey, secretKey: t.secretKey}, nil
+	}
+	if id := os.Getenv("AWS_ACCESS_KEY_ID"); id != "" {
+		return awsCredentials{
+			accessKey:    id,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if t.creds.accessKey != "" && now.Before(t.creds.expiry) {
+		return t.creds, nil
+	}
+
+	creds, err := instanceCredentials(imdsClient)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	redactSecrets(creds.secretKey, creds.sessionToken)
+
+	// refresh five minutes early, since a request signed just before they
+	// expire may not arrive in time
+	creds.expiry = creds.expiry.Add(-5 * time.Minute)
+	t.creds = creds
+	return creds, nil
+}
+
+// instanceCredentials returns the EC2 instance role's credentials, using an
+// IMDSv2 session token.
+func instanceCredentials(client *http.Client) (awsCredentials, error) {
+	req, err := http.NewRequest("PUT", imdsURL+"/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "300")
+	token, err := imdsGet(client, req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+
+	get := func(path string) (string, error) {
+		req, err := http.NewRequest("GET", imdsURL+"/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+		return imdsGet(client, req)
+	}
+
+	role, err := get("")
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	role = strings.TrimSpace(strings.SplitN(role, "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, fmt.Errorf("no instance role")
+	}
+
+	j, err := get(url.PathEscape(role))
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	var body struct {
+		AccessKeyID     string `json:"AccessKeyId"`
+		SecretAccessKey string
+		Token           string
+		Expiration      time.Time
+	}
+	if err := json.Unmarshal([]byte(j), &body); err != nil {
+		return awsCredentials{}, err
+	}
+	return awsCredentials{
+		accessKey:    body.AccessKeyID,
+		secretKey:    body.SecretAccessKey,
+		sessionToken: body.Token,
+		expiry:       body.Expiration,
+	}, nil
+}
+
+// imdsGet returns the body of a request to the instance metadata service.
+func imdsGet(client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("received a %s response from %s", resp.Status, req.URL.Path)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	return string(b), err
+}
+
+// canonicalPath returns the URL's path as it's signed. Every service except S3
+// expects the path as it's sent, already escaped, to be escaped again.
+func canonicalPath(u *url.URL, service string) string {
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if service != "s3" {
+		path = awsEscape(path, false)
+	}
+	return path
+}
+
+// canonicalQuery returns the query sorted by key and then value, escaped as
+// SigV4 expects.
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			pairs = append(pairs, awsEscape(k, true)+"="+awsEscape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsEscape percent-encodes everything but the unreserved characters, and
+// slashes too if it's escaping a query component.
+func awsEscape(s string, query bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !query) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	_, _ = h.Write([]byte(s))
+	return h.Sum(nil)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// The credentials, region, service, and time AWS's SigV4 test suite signs with.
+var (
+	suiteCreds = awsCredentials{accessKey: "AKIDEXAMPLE", secretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	suiteTime  = time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+)
+
+func TestSigV4Suite(t *testing.T) {
+	// the suite's requests sign only the host and X-Amz-Date, as authorize does
+	// when given nothing else
+	tests := []struct {
+		name      string
+		method    string
+		url       string
+		signature string
+	}{
+		{"get-vanilla", "GET", "/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"get-vanilla-empty-query-key", "GET", "/?Param1=value1", "a67d582fa61cc504c4bae71f336f98b97f1ea3c7a6bfe1b6e45aec72011b9aeb"},
+		{"get-vanilla-query-order-key-case", "GET", "/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"get-vanilla-query-unreserved", "GET", "/?-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz=-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz", "9c3e54bfcdf0b19771a7f523ee5669cdf59bc7cc0884027167c21bb143a40197"},
+		{"get-vanilla-utf8-query", "GET", "/?ሴ=bar", "2cdec8eed098649ff3a119c94853b13c643bcf08f8b0a1d91e12c9027818dd04"},
+		{"get-unreserved", "GET", "/-._~0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz", "07ef7494c76fa4850883e2b006601f940f8a34d404d0cfa977f52a65bbf5f24f"},
+		{"post-vanilla", "POST", "/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, "http://example.amazonaws.com"+tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("X-Amz-Date", "20150830T123600Z")
+
+			tr := &sigv4Transport{region: "us-east-1", service: "service"}
+			tr.authorize(req, sha256Hex(nil), suiteCreds, suiteTime)
+
+			want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+			if got := req.Header.Get("Authorization"); got != want {
+				t.Errorf("Authorization = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestSigV4CanonicalPath(t *testing.T) {
+	// S3 signs paths as they're sent, like the suite's get-space and get-utf8;
+	// every other service escapes them again
+	tests := []struct {
+		name    string
+		path    string
+		service string
+		want    string
+	}{
+		{"get-space, S3", "/example space/", "s3", "/example%20space/"},
+		{"get-utf8, S3", "/ሴ", "s3", "/%E1%88%B4"},
+		{"get-space", "/example space/", "service", "/example%2520space/"},
+		{"get-utf8", "/ሴ", "service", "/%25E1%2588%25B4"},
+		{"reserved characters", "/a+b=c,d@e", "service", "/a%2Bb%3Dc%2Cd%40e"},
+		{"unreserved characters", "/-._~", "service", "/-._~"},
+		{"empty", "", "service", "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canonicalPath(&url.URL{Path: tt.path}, tt.service); got != tt.want {
+				t.Errorf("canonicalPath(%q) = %s, want %s", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigV4CanonicalQuery(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"keys in order", "b=2&a=1&C=3", "C=3&a=1&b=2"},
+		{"values in order", "Param1=value2&Param1=Value1", "Param1=Value1&Param1=value2"},
+		{"reserved characters", "k=a%20b&k2=x/y%2Bz", "k=a%20b&k2=x%2Fy%2Bz"},
+		{"no value", "flag", "flag="},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := canonicalQuery(q); got != tt.want {
+				t.Errorf("canonicalQuery(%q) = %s, want %s", tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSigV4InstanceCredentials(t *testing.T) {
+	if os.Getenv("AWS_ACCESS_KEY_ID") != "" {
+		t.Skip("AWS_ACCESS_KEY_ID is set")
+	}
+
+	var leaked []string
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v := r.Header.Get("Authorization"); v != "" {
+			leaked = append(leaked, r.URL.Path+": "+v)
+		}
+		switch {
+		case r.Method == "PUT" && r.URL.Path == "/latest/api/token":
+			fmt.Fprint(w, "imds-token")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/":
+			fmt.Fprint(w, "collector\n")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/collector":
+			fmt.Fprintf(w, `{"AccessKeyId": "AKID", "SecretAccessKey": "secret", "Token": "session", "Expiration": %q}`,
+				time.Now().Add(time.Hour).Format(time.RFC3339))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer imds.Close()
+	defer func(u string) { imdsURL = u }(imdsURL)
+	imdsURL = imds.URL + "/latest"
+
+	var signed http.Header
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		signed = r.Header
+	}))
+	defer dst.Close()
+
+	// the transport under the signer adds an OAuth2 token, which the metadata
+	// service must never see
+	tokens := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"access_token": "oauth-token"}`)
+	}))
+	defer tokens.Close()
+	client := &http.Client{Transport: &sigv4Transport{
+		base:    &oauthTransport{base: http.DefaultTransport, tokenURL: tokens.URL},
+		region:  "us-east-1",
+		service: "execute-api",
+	}}
+
+	resp, err := client.Get(dst.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+
+	if len(leaked) > 0 {
+		t.Errorf("metadata requests carried credentials: %v", leaked)
+	}
+	if got := signed.Get("X-Amz-Security-Token"); got != "session" {
+		t.Errorf("X-Amz-Security-Token = %q, want the instance role's session token", got)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+)
+
+// A sink is where batches are sent: Librato, or another backend in its place.
+// encode returns a chunk's body, given the JSON which would be posted to
+// Librato, and send sends it, panicking if it isn't accepted. Sends are
+// retried, so a chunk is only encoded once.
+type sink interface {
+	encode(b batch, j []byte) []byte
+	send(ctx context.Context, body []byte, key, id string, cfg *config)
+}
+
+// newSink returns the sink for -ndjson-url, -remote-write-url, or -exec-sink, of
+// which at most one may be given, or Librato's.
+func newSink(cfg *config) (sink, error) {
+	var sinks []sink
+	if cfg.ndjsonURL != "" {
+		sinks = append(sinks, ndjsonSink{url: cfg.ndjsonURL})
+	}
+	if cfg.remoteWriteURL != "" {
+		sinks = append(sinks, remoteWriteSink{url: cfg.remoteWriteURL})
+	}
+	if cfg.execSink != "" {
+		sinks = append(sinks, execSink{command: cfg.execSink})
+	}
+
+	switch len(sinks) {
+	case 0:
+		if cfg.tagged {
+			return libratoSink{endpoint: measurementsEndpoint}, nil
+		}
+		return libratoSink{endpoint: metricsEndpoint}, nil
+	case 1:
+		return sinks[0], nil
+	}
+	return nil, fmt.Errorf("only one of -ndjson-url, -remote-write-url, and -exec-sink may be given")
+}
+
+// A libratoSink posts batches to one of Librato's APIs.
+type libratoSink struct {
+	endpoint string
+}
+
+func (s libratoSink) encode(b batch, j []byte) []byte {
+	return j
+}
+
+func (s libratoSink) send(ctx context.Context, body []byte, key, id string, cfg *config) {
+	postBody(ctx, s.endpoint, body, key, id, cfg)
+}
+
+// An execSink runs a shell command with a batch's JSON on its stdin, in place of
+// posting it to Librato. A non-zero exit is a failed post, and is retried like
+// one. The command is killed if the collection runs past -collect-timeout.
+// Anything it writes to stderr is logged.
+type execSink struct {
+	command string
+}
+
+func (s execSink) encode(b batch, j []byte) []byte {
+	return j
+}
+
+func (s execSink) send(ctx context.Context, j []byte, key, id string, cfg *config) {
+	stderr := bytes.NewBuffer(nil)
+	cmd := shellCommand(ctx, s.command)
+	cmd.Env = append(os.Environ(), "COLLECT_IDEMPOTENCY_KEY="+key)
+	cmd.Stdin = bytes.NewReader(j)
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		log.Printf("  exec sink: %s", scanner.Text())
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		panic(fmt.Errorf("exec sink ran past -collect-timeout (%s)", cfg.collectTimeout))
+	}
+	if err != nil {
+		panic(fmt.Errorf("exec sink failed: %v", err))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// sourceData is what a -source template is evaluated against, once per
+// collection, after the URL has been fetched. For example:
+//
+//	{{.Label}}-{{.Path "cluster.node_id"}}
+type sourceData struct {
+	URL   *url.URL // the fetched URL
+	Host  string   // the URL's host, without a port
+	Label string   // the first label of the URL's host
+	doc   *jsonq.JsonQuery
+}
+
+// Path returns the value at a JSON path in the fetched document.
+func (d sourceData) Path(path string) (interface{}, error) {
+	return d.doc.Interface(strings.Split(path, ".")...)
+}
+
+// parseSource returns a template for the source, or nil if it's not a
+// template.
+func parseSource(source string) (*template.Template, error) {
+	if !strings.Contains(source, "{{") {
+		return nil, nil
+	}
+	return template.New("source").Option("missingkey=error").Parse(source)
+}
+
+// renderSource evaluates the source template for a fetched URL.
+func renderSource(tmpl *template.Template, metricsURL string, doc *jsonq.JsonQuery) (string, error) {
+	u, err := url.Parse(metricsURL)
+	if err != nil {
+		return "", err
+	}
+
+	host := u.Hostname()
+	data := sourceData{
+		URL:   u,
+		Host:  host,
+		Label: strings.SplitN(host, ".", 2)[0],
+		doc:   doc,
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := tmpl.Execute(buf, data); err != nil {
+		return "", err
+	}
+
+	source := strings.TrimSpace(buf.String())
+	if source == "" {
+		return "", errors.New("source template rendered an empty source")
+	}
+	return source, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// stats tracks collections across ticks, for periodic summaries.
+type stats struct {
+	sync.Mutex
+	collections int
+	failures    int
+	metrics     int
+	elapsed     time.Duration
+	lastErr     error
+
+	// with -summary-ranges, the lowest and highest value posted of each metric
+	ranges map[string]valueRange
+}
+
+// A valueRange is the lowest and highest value of a metric.
+type valueRange struct {
+	min, max float64
+}
+
+// observe records the values of the batch's metrics, if ranges are tracked.
+func (s *stats) observe(b batch) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.ranges == nil {
+		return
+	}
+
+	see := func(name string, v float64) {
+		r, ok := s.ranges[name]
+		if !ok {
+			r = valueRange{min: v, max: v}
+		}
+		if v < r.min {
+			r.min = v
+		}
+		if v > r.max {
+			r.max = v
+		}
+		s.ranges[name] = r
+	}
+	for name, g := range b.Gauges {
+		see(name, g.Value)
+	}
+	for name, c := range b.Counters {
+		see(name, float64(c.Value))
+	}
+}
+
+// sent records the number of metrics posted.
+func (s *stats) sent(n int) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.metrics += n
+}
+
+// collected records a collection's duration and result.
+func (s *stats) collected(d time.Duration, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.collections++
+	s.elapsed += d
+	if err != nil {
+		s.failures++
+		s.lastErr = err
+	}
+}
+
+// summarize logs the stats since the last summary, then resets them. The last
+// error is kept until there's a newer one.
+func (s *stats) summarize() {
+	s.Lock()
+	defer s.Unlock()
+
+	var avg time.Duration
+	if s.collections > 0 {
+		avg = s.elapsed / time.Duration(s.collections)
+	}
+
+	log.Printf("summary: %d collections, %d failures, %d metrics sent, %s average duration",
+		s.collections, s.failures, s.metrics, avg)
+	if s.lastErr != nil {
+		log.Printf("summary: last error: %v", s.lastErr)
+	}
+
+	// a metric whose min and max are the same hasn't changed at all
+	if s.ranges != nil {
+		names := make([]string, 0, len(s.ranges))
+		for name := range s.ranges {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			r := s.ranges[name]
+			log.Printf("summary: %s min=%v max=%v", name, r.min, r.max)
+		}
+		s.ranges = make(map[string]valueRange)
+	}
+
+	s.collections, s.failures, s.metrics, s.elapsed = 0, 0, 0, 0
+}
+
+// run logs a summary once per interval.
+func (s *stats) run(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		s.summarize()
+	}
+}
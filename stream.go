@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A stream reads JSON documents pushed by a Server-Sent Events endpoint,
+// deep-merging each event into the stream's state, which is collected once per
+// period like a fetched document.
+type stream struct {
+	sync.Mutex
+	url   string
+	doc   map[string]interface{}
+	fresh bool
+}
+
+// take returns a copy of the stream's state, and whether there have been any
+// events since it was last taken.
+func (s *stream) take() (map[string]interface{}, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	fresh := s.fresh
+	s.fresh = false
+	if s.doc == nil {
+		return nil, fresh
+	}
+	return deepCopy(s.doc).(map[string]interface{}), fresh
+}
+
+// run reads the stream until the process exits, reconnecting with an
+// exponential backoff whenever it's disconnected.
+func (s *stream) run(cfg *config) {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := s.read(cfg)
+		if time.Since(start) > time.Minute {
+			backoff = time.Second
+		}
+
+		log.Printf("stream %s disconnected, reconnecting in %s: %v", s.url, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// read connects to the stream and reads events until it's disconnected.
+func (s *stream) read(cfg *config) error {
+	req, err := http.NewRequest("GET", s.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	for _, c := range cfg.cookies {
+		req.AddCookie(c)
+	}
+
+	// a stream is read for as long as it stays open, so it's not bound by
+	// -collect-timeout
+	resp, err := cfg.fetcher.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("received a %s response", resp.Status)
+	}
+	log.Printf("stream %s connected", s.url)
+
+	var data []string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			// a blank line dispatches the event
+			if len(data) > 0 {
+				s.event(strings.Join(data, "\n"))
+				data = data[:0]
+			}
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+		// comments, event names, ids, and retry hints are ignored
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("stream ended")
+}
+
+// event merges an event's JSON payload into the stream's state.
+func (s *stream) event(payload string) {
+	doc, err := decodeDocument("json", strings.NewReader(payload))
+	if err != nil {
+		log.Printf("stream %s: bad event: %v", s.url, err)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.doc == nil {
+		s.doc = make(map[string]interface{})
+	}
+	merge(s.doc, doc)
+	s.fresh = true
+}
+
+// deepCopy returns a copy of a decoded JSON value which shares no objects or
+// arrays with the original.
+func deepCopy(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = deepCopy(e)
+		}
+		return a
+	}
+	return v
+}
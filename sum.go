@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// A sumMetric sums a field of every value in an object, whatever their keys,
+// such as the hits of each route in {"endpoints":{"/a":{"hits":10},...}}.
+type sumMetric struct {
+	object string
+	field  string
+	name   string
+}
+
+// parseSumMetric parses a metric of the form object.*.field[=name]. Without a
+// name, it's named after the object and field.
+func parseSumMetric(s string) (sumMetric, error) {
+	var m sumMetric
+
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		s, m.name = s[:i], s[i+1:]
+	}
+
+	i := strings.Index(s, ".*.")
+	if i <= 0 || i+3 >= len(s) {
+		return m, fmt.Errorf("expected object.*.field in %q", s)
+	}
+	m.object, m.field = s[:i], s[i+3:]
+	return m, nil
+}
+
+// sum adds a gauge of the sum to the batch. Values which are missing the field,
+// or whose field isn't a number, are skipped with a warning.
+func (m sumMetric) sum(jq *jsonq.JsonQuery, b *batch, cfg *config, t *tally) {
+	obj, err := jq.Object(strings.Split(m.object, ".")...)
+	if err != nil {
+		t.fail(fmt.Errorf("%s: %v", m.object, err))
+		return
+	}
+
+	var total float64
+	for k, e := range obj {
+		child, ok := e.(map[string]interface{})
+		if !ok {
+			log.Printf("  warning: %s.%s is %v, not an object, skipping", m.object, k, e)
+			continue
+		}
+
+		v, err := cfg.gaugeValue(jsonq.NewQuery(child), metric{path: m.field})
+		if err != nil {
+			log.Printf("  warning: %s.%s.%s: %v, skipping", m.object, k, m.field, err)
+			continue
+		}
+		total += v
+	}
+
+	name := m.name
+	if name == "" {
+		keys := append(strings.Split(m.object, "."), strings.Split(m.field, ".")...)
+		name = strings.Join(keys, cfg.separator)
+	}
+	name = cfg.suffixGauge(cfg.qualify(name))
+	log.Printf("  %s=%v", name, total)
+	b.Gauges[name] = gauge{Value: total}
+}
+
+type sumMetricList []sumMetric
+
+func (l *sumMetricList) Set(v string) error {
+	m, err := parseSumMetric(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, m)
+	return nil
+}
+
+func (l *sumMetricList) String() string {
+	s := make([]string, len(*l))
+	for i, m := range *l {
+		s[i] = m.object + ".*." + m.field
+		if m.name != "" {
+			s[i] += "=" + m.name
+		}
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+	"gopkg.in/yaml.v3"
+)
+
+// A taggedPayload is a batch in the form of Librato's tagged measurements API.
+type taggedPayload struct {
+	Tags         map[string]string `json:"tags"`
+	Time         int64             `json:"time,omitempty"`
+	Measurements []measurement     `json:"measurements"`
+}
+
+type measurement struct {
+	Name       string            `json:"name"`
+	Value      json.Number       `json:"value"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Attributes *attributes       `json:"attributes,omitempty"`
+}
+
+func (m measurement) MarshalJSON() ([]byte, error) {
+	type plain measurement
+	return withExtraFields(json.Marshal(plain(m)))
+}
+
+// attributes are a measurement's metric attributes, which tell Librato how to
+// summarize its rollups: gauges by their average, and counters, which are
+// posted as deltas, by their sum.
+type attributes struct {
+	SummarizeFunction string `json:"summarize_function"`
+}
+
+var (
+	gaugeAttributes   = &attributes{SummarizeFunction: "average"}
+	counterAttributes = &attributes{SummarizeFunction: "sum"}
+)
+
+// tagged converts the batch to a tagged measurements payload. Unless it's
+// tagged otherwise, the batch's source is sent as the source tag.
+func (b batch) tagged() taggedPayload {
+	p := taggedPayload{
+		Tags: make(map[string]string, len(b.Tags)+1),
+		Time: b.MeasureTime,
+	}
+
+	p.Tags["source"] = b.Source
+	for k, v := range b.Tags {
+		p.Tags[k] = v
+	}
+
+	for _, name := range b.gaugeNames() {
+		p.Measurements = append(p.Measurements, measurement{
+			Name:       name,
+			Value:      json.Number(formatPosted(b.Gauges[name].Value)),
+			Tags:       b.measurementTags(p.Tags, name),
+			Attributes: gaugeAttributes,
+		})
+	}
+
+	for _, name := range b.counterNames() {
+		p.Measurements = append(p.Measurements, measurement{
+			Name:       name,
+			Value:      json.Number(formatCounter(b.Counters[name].Value)),
+			Tags:       b.measurementTags(p.Tags, name),
+			Attributes: counterAttributes,
+		})
+	}
+
+	return p
+}
+
+// postsDeltas returns true if counters are posted to the tagged API, which has
+// no counters of its own, so they're posted as deltas to be summed.
+func (c *config) postsDeltas() bool {
+	_, ok := c.sink.(libratoSink)
+	return c.tagged && ok
+}
+
+// counterDeltas returns a copy of the batch with each counter's running total
+// replaced by how much it's grown since it was last posted. A counter seen for
+// the first time has nothing to compare to, so it's left out until the next
+// collection. One which has gone down was reset, so its whole value is new.
+func (c *config) counterDeltas(b batch) batch {
+	counters := make(map[string]counter, len(b.Counters))
+	for name, v := range b.Counters {
+		last, ok := c.totals[postingKey(b.Source, "counter", name)]
+		switch {
+		case !ok:
+			log.Printf("  %s has no previous total, posting its delta from the next collection", name)
+		case v.Value < last:
+			counters[name] = v
+		default:
+			counters[name] = counter{Value: v.Value - last}
+		}
+	}
+	b.Counters = counters
+	return b
+}
+
+// rememberTotals records the running totals of the batch's counters, for their
+// next deltas.
+func (c *config) rememberTotals(b batch) {
+	if !c.postsDeltas() {
+		return
+	}
+
+	if c.totals == nil {
+		c.totals = make(map[string]int64)
+	}
+	for name, v := range b.Counters {
+		c.totals[postingKey(b.Source, "counter", name)] = v.Value
+	}
+}
+
+// measurementTags returns a measurement's full set of tags, which replace the
+// payload's, or nil if it has none of its own. This lets one payload carry
+// measurements with different sets of tags.
+func (b batch) measurementTags(payload map[string]string, name string) map[string]string {
+	own, ok := b.MetricTags[name]
+	if !ok {
+		return nil
+	}
+
+	tags := make(map[string]string, len(payload)+len(own))
+	for k, v := range payload {
+		tags[k] = v
+	}
+	for k, v := range own {
+		tags[k] = v
+	}
+	return tags
+}
+
+// addTags tags the batch with the static tags and the tags read from the
+// document. A tag whose path is missing is left off, with a warning, in either
+// mode; one whose value isn't a scalar fails the collection.
+func (c *config) addTags(jq *jsonq.JsonQuery, b *batch, t *tally) {
+	b.Tags = make(map[string]string, len(c.tags)+len(c.tagPaths))
+	for k, v := range c.tags {
+		b.Tags[k] = v
+	}
+
+	for k, path := range c.tagPaths {
+		v, err := jq.Interface(strings.Split(path, ".")...)
+		if err != nil {
+			log.Printf("  warning: tag %s: %s: %v, leaving it off", k, path, err)
+			continue
+		}
+
+		switch v.(type) {
+		case string, json.Number, float64, bool:
+			b.Tags[k] = fmt.Sprint(v)
+			log.Printf("  tag %s=%s", k, b.Tags[k])
+		default:
+			t.fail(fmt.Errorf("tag %s: %s: expected a string, got %v", k, path, v))
+		}
+	}
+}
+
+// loadTagsFile reads a JSON or YAML map of tag names to values, adding any
+// which aren't already set to the tags.
+func loadTagsFile(name string, tags *tagMap) error {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	var file map[string]string
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &file)
+	default:
+		err = json.Unmarshal(data, &file)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+
+	if *tags == nil {
+		*tags = make(tagMap)
+	}
+	for k, v := range file {
+		if _, ok := (*tags)[k]; !ok {
+			(*tags)[k] = v
+		}
+	}
+	return nil
+}
+
+// tagMap is a set of name=value pairs.
+type tagMap map[string]string
+
+func (m *tagMap) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected name=value, got %q", v)
+	}
+
+	if *m == nil {
+		*m = make(tagMap)
+	}
+	(*m)[v[:i]] = v[i+1:]
+	return nil
+}
+
+func (m *tagMap) String() string {
+	s := make([]string, 0, len(*m))
+	for k, v := range *m {
+		s = append(s, k+"="+v)
+	}
+	return strings.Join(s, ",")
+}
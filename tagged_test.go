@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jmoiron/jsonq"
+)
+
+func TestTaggedAttributes(t *testing.T) {
+	b := batch{
+		Gauges:   map[string]gauge{"heap": {Value: 1.5}},
+		Counters: map[string]counter{"requests": {Value: 42}},
+		Source:   "web",
+	}
+	j, err := json.Marshal(b.tagged())
+	if err != nil {
+		t.Fatalf("json.Marshal() error = %v", err)
+	}
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"gauges are averaged", `{"name":"heap","value":1.5,"attributes":{"summarize_function":"average"}}`},
+		{"counters are summed", `{"name":"requests","value":42,"attributes":{"summarize_function":"sum"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !strings.Contains(string(j), tt.want) {
+				t.Errorf("posted %s, want it to contain %s", j, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterDeltas(t *testing.T) {
+	cfg := &config{tagged: true, sink: libratoSink{endpoint: measurementsEndpoint}}
+
+	tests := []struct {
+		name  string
+		total int64
+		want  map[string]counter
+	}{
+		{"first collection", 100, map[string]counter{}},
+		{"grown", 130, map[string]counter{"requests": {Value: 30}}},
+		{"unchanged", 130, map[string]counter{"requests": {Value: 0}}},
+		{"reset", 12, map[string]counter{"requests": {Value: 12}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := batch{Counters: map[string]counter{"requests": {Value: tt.total}}, Source: "web"}
+			got := cfg.counterDeltas(b)
+			cfg.rememberTotals(b)
+
+			if fmt.Sprint(got.Counters) != fmt.Sprint(tt.want) {
+				t.Errorf("counterDeltas() = %v, want %v", got.Counters, tt.want)
+			}
+			if b.Counters["requests"].Value != tt.total {
+				t.Errorf("counterDeltas() changed the batch's total to %v", b.Counters["requests"].Value)
+			}
+		})
+	}
+}
+
+func TestMeasurementTags(t *testing.T) {
+	b := batch{
+		Gauges: map[string]gauge{
+			"heap":  {Value: 1},
+			"load":  {Value: 2},
+			"queue": {Value: 3},
+		},
+		Source: "web",
+		Tags:   map[string]string{"env": "prod", "region": "us-east"},
+		MetricTags: map[string]map[string]string{
+			"heap":  {"pool": "old"},
+			"load":  {"region": "eu-west"},
+			"queue": {"name": "jobs", "env": "staging"},
+		},
+	}
+
+	tests := []struct {
+		name string
+		want map[string]string
+	}{
+		{"heap", map[string]string{"source": "web", "env": "prod", "region": "us-east", "pool": "old"}},
+		{"load", map[string]string{"source": "web", "env": "prod", "region": "eu-west"}},
+		{"queue", map[string]string{"source": "web", "env": "staging", "region": "us-east", "name": "jobs"}},
+	}
+
+	// each chunk holds a single measurement, which must keep its own tags
+	chunks := b.chunks(1)
+	if len(chunks) != len(tests) {
+		t.Fatalf("chunks(1) returned %d chunks, want %d", len(chunks), len(tests))
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, p := range []taggedPayload{b.tagged(), chunks[i].tagged()} {
+				var m *measurement
+				for j := range p.Measurements {
+					if p.Measurements[j].Name == tt.name {
+						m = &p.Measurements[j]
+					}
+				}
+				if m == nil {
+					t.Fatalf("no %s measurement in %+v", tt.name, p)
+				}
+
+				if fmt.Sprint(m.Tags) != fmt.Sprint(tt.want) {
+					t.Errorf("%s tags = %v, want %v", tt.name, m.Tags, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAddTags(t *testing.T) {
+	doc := map[string]interface{}{
+		"cluster": map[string]interface{}{"region": "us-east", "size": json.Number("3"), "nodes": []interface{}{}},
+	}
+
+	tests := []struct {
+		name       string
+		bestEffort bool
+		path       string
+		want       map[string]string
+		wantErr    bool
+	}{
+		{"string", false, "cluster.region", map[string]string{"env": "prod", "t": "us-east"}, false},
+		{"number", false, "cluster.size", map[string]string{"env": "prod", "t": "3"}, false},
+		{"missing", false, "cluster.zone", map[string]string{"env": "prod"}, false},
+		{"missing with -mode best-effort", true, "cluster.zone", map[string]string{"env": "prod"}, false},
+		{"not a scalar", false, "cluster.nodes", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{tags: tagMap{"env": "prod"}, tagPaths: tagMap{"t": tt.path}}
+			b := batch{}
+			err := try(func() { cfg.addTags(jsonq.NewQuery(doc), &b, &tally{bestEffort: tt.bestEffort}) })
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("addTags() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && fmt.Sprint(b.Tags) != fmt.Sprint(tt.want) {
+				t.Errorf("tags = %v, want %v", b.Tags, tt.want)
+			}
+		})
+	}
+}
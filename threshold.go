@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// A threshold is a bound on a metric's value, like "heap.used:>1e9", which is
+// warned about in the logs whenever it's crossed.
+type threshold struct {
+	name  string
+	above bool
+	bound float64
+}
+
+// parseThreshold parses a threshold of the form name:>value or name:<value.
+func parseThreshold(s string) (threshold, error) {
+	var t threshold
+
+	i := strings.LastIndex(s, ":")
+	if i <= 0 || i+1 >= len(s) || (s[i+1] != '>' && s[i+1] != '<') {
+		return t, fmt.Errorf("expected name:>value or name:<value, got %q", s)
+	}
+
+	bound, err := strconv.ParseFloat(s[i+2:], 64)
+	if err != nil {
+		return t, fmt.Errorf("bad bound in %q: %v", s, err)
+	}
+	return threshold{name: s[:i], above: s[i+1] == '>', bound: bound}, nil
+}
+
+func (t threshold) crossed(v float64) bool {
+	if t.above {
+		return v > t.bound
+	}
+	return v < t.bound
+}
+
+func (t threshold) String() string {
+	op := "<"
+	if t.above {
+		op = ">"
+	}
+	return t.name + ":" + op + strconv.FormatFloat(t.bound, 'g', -1, 64)
+}
+
+// checkThresholds warns about any of the batch's metrics which have crossed
+// their thresholds. Thresholds are on the metrics' names as they're posted.
+func (c *config) checkThresholds(b batch) {
+	for _, t := range c.thresholds {
+		if g, ok := b.Gauges[t.name]; ok && t.crossed(g.Value) {
+			log.Printf("  warning: %s is %v, crossing %s", t.name, g.Value, t)
+		}
+		if v, ok := b.Counters[t.name]; ok && t.crossed(float64(v.Value)) {
+			log.Printf("  warning: %s is %v, crossing %s", t.name, v.Value, t)
+		}
+	}
+}
+
+type thresholdList []threshold
+
+func (l *thresholdList) Set(v string) error {
+	t, err := parseThreshold(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, t)
+	return nil
+}
+
+func (l *thresholdList) String() string {
+	s := make([]string, len(*l))
+	for i, t := range *l {
+		s[i] = t.String()
+	}
+	return strings.Join(s, ",")
+}
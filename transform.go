@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A transform is a sequence of arithmetic operations which are applied, left
+// to right, to a metric's value. "/1048576" converts bytes to megabytes, and
+// "*9/5+32" converts Celsius to Fahrenheit.
+type transform struct {
+	ops  []byte
+	args []float64
+}
+
+// parseTransform parses an expression of the form [x]{op number}, where op is
+// one of +, -, *, or /.
+func parseTransform(expr string) (transform, error) {
+	var t transform
+
+	s := strings.TrimPrefix(strings.Replace(expr, " ", "", -1), "x")
+	if s == "" {
+		return t, fmt.Errorf("empty transform")
+	}
+
+	for s != "" {
+		op := s[0]
+		if strings.IndexByte("+-*/", op) < 0 {
+			return t, fmt.Errorf("bad operator %q in %q", op, expr)
+		}
+
+		// the operand runs up to the next operator, skipping a leading sign and
+		// any exponent sign
+		end := 1
+		for end < len(s) {
+			c := s[end]
+			if strings.IndexByte("+-*/", c) >= 0 && end > 1 && s[end-1] != 'e' && s[end-1] != 'E' {
+				break
+			}
+			end++
+		}
+
+		arg, err := strconv.ParseFloat(s[1:end], 64)
+		if err != nil {
+			return t, fmt.Errorf("bad operand in %q: %v", expr, err)
+		}
+
+		t.ops = append(t.ops, op)
+		t.args = append(t.args, arg)
+		s = s[end:]
+	}
+
+	return t, nil
+}
+
+// apply returns the transformed value.
+func (t transform) apply(v float64) float64 {
+	for i, op := range t.ops {
+		switch op {
+		case '+':
+			v += t.args[i]
+		case '-':
+			v -= t.args[i]
+		case '*':
+			v *= t.args[i]
+		case '/':
+			v /= t.args[i]
+		}
+	}
+	return v
+}
+
+// transformMap maps metric names to their transforms.
+type transformMap map[string]transform
+
+func (m *transformMap) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i < 0 {
+		return fmt.Errorf("expected name=expression, got %q", v)
+	}
+
+	t, err := parseTransform(v[i+1:])
+	if err != nil {
+		return err
+	}
+
+	if *m == nil {
+		*m = make(transformMap)
+	}
+	(*m)[v[:i]] = t
+	return nil
+}
+
+func (m *transformMap) String() string {
+	names := make([]string, 0, len(*m))
+	for name := range *m {
+		names = append(names, name)
+	}
+	return strings.Join(names, ",")
+}
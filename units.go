@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// errSkipped means a metric's value couldn't be used, which has already been
+// warned about, and the metric should be skipped without failing the
+// collection.
+var errSkipped = errors.New("skipped")
+
+// byteUnits are the multipliers of the byte suffixes -parse-units accepts,
+// upper-cased. Unqualified suffixes are decimal.
+var byteUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"K":   1e3,
+	"KB":  1e3,
+	"M":   1e6,
+	"MB":  1e6,
+	"G":   1e9,
+	"GB":  1e9,
+	"T":   1e12,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseUnits parses a duration (e.g. "200ms") into seconds, or a size (e.g.
+// "1.5GB") into bytes. Durations are case-sensitive, so "5m" is five minutes
+// and "5M" is five million bytes.
+func parseUnits(s string) (json.Number, error) {
+	s = strings.TrimSpace(s)
+	if d, err := time.ParseDuration(s); err == nil {
+		return json.Number(strconv.FormatFloat(d.Seconds(), 'f', -1, 64)), nil
+	}
+
+	i := strings.IndexFunc(s, unicode.IsLetter)
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(s[:i]), 64)
+	if err != nil {
+		return "", fmt.Errorf("unable to parse %q", s)
+	}
+	mult, ok := byteUnits[strings.ToUpper(s[i:])]
+	if !ok {
+		return "", fmt.Errorf("unknown unit in %q", s)
+	}
+	return json.Number(strconv.FormatFloat(n*mult, 'f', -1, 64)), nil
+}
+
+// unstring converts a string value to a number, if -parse-units or
+// -coerce-strings applies to it, and returns other values as-is. With
+// -skip-non-numeric, any other string is skipped.
+func (c *config) unstring(m metric, v interface{}) (interface{}, error) {
+	s, ok := v.(string)
+	if !ok {
+		return v, nil
+	}
+
+	if c.units[m.path] {
+		n, err := parseUnits(s)
+		if err != nil && c.strict {
+			return nil, err
+		} else if err != nil {
+			log.Printf("  warning: %s: %v, skipping", m.path, err)
+			return nil, errSkipped
+		}
+		log.Printf("  parsed %s from %q", m.path, s)
+		return n, nil
+	}
+
+	if n, ok := c.coerce(m, s); ok {
+		return n, nil
+	}
+	if c.skipNonNumeric {
+		log.Printf("  warning: %s is %q, not a number, skipping", m.path, s)
+		return nil, errSkipped
+	}
+	return v, nil
+}
+
+// unitList is a set of paths whose values -parse-units parses.
+type unitList map[string]bool
+
+func (l *unitList) Set(v string) error {
+	if *l == nil {
+		*l = make(unitList)
+	}
+	(*l)[v] = true
+	return nil
+}
+
+func (l *unitList) String() string {
+	var s []string
+	for path := range *l {
+		s = append(s, path)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A vault reads the Librato email and token from a HashiCorp Vault secret,
+// which has email and token fields. It authenticates with a token or, if a
+// role ID is given, by logging in with AppRole.
+type vault struct {
+	addr     string
+	token    string
+	roleID   string
+	secretID string
+	path     string
+	client   *http.Client
+
+	sync.Mutex
+	email, librato string
+}
+
+// credentials returns the most recently read email and token.
+func (v *vault) credentials() (email, token string) {
+	v.Lock()
+	defer v.Unlock()
+	return v.email, v.librato
+}
+
+// load reads the credentials from Vault.
+func (v *vault) load() error {
+	token := v.token
+	if v.roleID != "" {
+		t, err := v.login()
+		if err != nil {
+			return fmt.Errorf("AppRole login: %v", err)
+		}
+		token = t
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.do("GET", v.path, token, nil, &secret); err != nil {
+		return err
+	}
+
+	// a KV version 2 secret's fields are nested under another data
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	email, _ := data["email"].(string)
+	librato, _ := data["token"].(string)
+	if librato == "" {
+		return fmt.Errorf("no token in %s", v.path)
+	}
+
+	redactSecrets(email, librato, strings.TrimPrefix(basicAuth(email, librato), "Basic "))
+
+	v.Lock()
+	v.email, v.librato = email, librato
+	v.Unlock()
+	return nil
+}
+
+// login logs in with AppRole, returning a client token.
+func (v *vault) login() (string, error) {
+	body, err := json.Marshal(map[string]string{"role_id": v.roleID, "secret_id": v.secretID})
+	if err != nil {
+		return "", err
+	}
+
+	var auth struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	if err := v.do("POST", "auth/approle/login", "", body, &auth); err != nil {
+		return "", err
+	}
+	redactSecrets(auth.Auth.ClientToken)
+	return auth.Auth.ClientToken, nil
+}
+
+// do makes a request of Vault's API and decodes the response.
+func (v *vault) do(method, path, token string, body []byte, resp interface{}) error {
+	u := strings.TrimSuffix(v.addr, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	r, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != 200 {
+		return fmt.Errorf("received a %s response from %s", r.Status, path)
+	}
+	return json.NewDecoder(r.Body).Decode(resp)
+}
+
+// run re-reads the credentials periodically, so they can be rotated. If Vault
+// can't be read, the previous credentials are kept.
+func (v *vault) run(interval time.Duration) {
+	for _ = range time.Tick(interval) {
+		if err := v.load(); err != nil {
+			log.Printf("unable to refresh credentials from Vault, keeping the old ones: %v", err)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// watchdogExit is the exit status when the watchdog fires, so a supervisor can
+// tell a wedged collector from a crashed one.
+const watchdogExit = 3
+
+// A watchdog exits the process if it isn't reset within its window. It's reset
+// only when a chunk is posted, including replays from -buffer-dir, so a
+// collector which keeps collecting but never posts (because its source is
+// stale, its batches are empty, or -dedupe drops everything) is still
+// restarted. With -batch-interval, posts are that far apart, so the window has
+// to be longer.
+type watchdog struct {
+	window time.Duration
+	timer  *time.Timer
+}
+
+func newWatchdog(window time.Duration) *watchdog {
+	return startWatchdog(window, func() {
+		log.Printf("watchdog: nothing posted in %s, exiting", window)
+		os.Exit(watchdogExit)
+	})
+}
+
+// startWatchdog returns a watchdog which calls expire if it isn't reset within
+// its window.
+func startWatchdog(window time.Duration, expire func()) *watchdog {
+	return &watchdog{
+		window: window,
+		timer:  time.AfterFunc(window, expire),
+	}
+}
+
+// reset restarts the watchdog's window. A nil watchdog does nothing.
+func (w *watchdog) reset() {
+	if w == nil {
+		return
+	}
+	w.timer.Reset(w.window)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdogResetsOnlyOnPosts(t *testing.T) {
+	const window = 300 * time.Millisecond
+
+	src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"heap": {"used": 1024}}`))
+	}))
+	defer src.Close()
+
+	var posts int32
+	dst := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		atomic.AddInt32(&posts, 1)
+	}))
+	defer dst.Close()
+
+	heap, err := parseMetric("heap.used")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		gauges    metricList
+		dedupe    time.Duration
+		wantPosts int32
+		wantFired bool
+	}{
+		{"posted", metricList{heap}, 0, 1, false},
+		{"empty batch", nil, 0, 0, true},
+		{"deduped", metricList{heap}, time.Hour, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config{
+				format:          "json",
+				separator:       ".",
+				gauges:          tt.gauges,
+				dedupeWindow:    tt.dedupe,
+				sourceCount:     1,
+				sampleRate:      1,
+				postMethod:      "POST",
+				postRetries:     1,
+				retryBackoff:    time.Millisecond,
+				postConcurrency: 1,
+				fetcher:         http.DefaultClient,
+				poster:          http.DefaultClient,
+				sink:            libratoSink{endpoint: dst.URL},
+			}
+			tgt := &target{urls: []string{src.URL}, source: "web"}
+
+			// with -dedupe, the first collection posts what the second skips
+			if tt.dedupe > 0 {
+				if err := collect(tgt, cfg); err != nil {
+					t.Fatalf("collect() error = %v", err)
+				}
+			}
+			atomic.StoreInt32(&posts, 0)
+
+			var fired int32
+			cfg.watchdog = startWatchdog(window, func() { atomic.StoreInt32(&fired, 1) })
+			defer cfg.watchdog.timer.Stop()
+
+			// the collection succeeds two thirds of the way through the window,
+			// and the watchdog is checked two thirds of the way through the next
+			time.Sleep(window * 2 / 3)
+			if err := collect(tgt, cfg); err != nil {
+				t.Fatalf("collect() error = %v", err)
+			}
+			time.Sleep(window * 2 / 3)
+
+			if got := atomic.LoadInt32(&posts); got != tt.wantPosts {
+				t.Errorf("posted %d times, want %d", got, tt.wantPosts)
+			}
+			if got := atomic.LoadInt32(&fired) == 1; got != tt.wantFired {
+				t.Errorf("watchdog fired = %v, want %v", got, tt.wantFired)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/jsonq"
+)
+
+// A condition gates metrics on a value in the document, such as
+// "queue.enabled==true metrics=queue.*". When it doesn't hold, the metrics
+// whose names match its globs are left out of the batch, or, if it has none,
+// all the metrics from the document and any constants are.
+type condition struct {
+	path    string
+	op      string
+	value   string
+	metrics globList
+}
+
+// conditionOps are the comparisons a condition may make, with the two-character
+// ones first so they're matched whole.
+var conditionOps = []string{"==", "!=", ">=", "<=", ">", "<"}
+
+// parseCondition parses a condition of the form path<op>value [metrics=glob,...].
+func parseCondition(s string) (condition, error) {
+	var c condition
+
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return c, fmt.Errorf("empty condition")
+	}
+
+	i, op := -1, ""
+	for _, o := range conditionOps {
+		if j := strings.Index(fields[0], o); j > 0 && (i < 0 || j < i) {
+			i, op = j, o
+		}
+	}
+	if i < 0 {
+		return c, fmt.Errorf("expected path, a comparison, and a value in %q", s)
+	}
+	c.path, c.op, c.value = fields[0][:i], op, fields[0][i+len(op):]
+
+	for _, f := range fields[1:] {
+		if !strings.HasPrefix(f, "metrics=") {
+			return c, fmt.Errorf("unknown option %q in %q", f, s)
+		}
+		for _, g := range strings.Split(strings.TrimPrefix(f, "metrics="), ",") {
+			if err := c.metrics.Set(g); err != nil {
+				return c, err
+			}
+		}
+	}
+	return c, nil
+}
+
+// holds returns true if the condition holds for the document. Numbers are
+// compared numerically, and anything else as strings, which can only be equal
+// or not. A missing path never holds.
+func (c condition) holds(jq *jsonq.JsonQuery) bool {
+	v, err := jq.Interface(strings.Split(c.path, ".")...)
+	if err != nil {
+		return false
+	}
+	s := fmt.Sprint(v)
+
+	a, aerr := strconv.ParseFloat(s, 64)
+	b, berr := strconv.ParseFloat(c.value, 64)
+	if aerr != nil || berr != nil {
+		switch c.op {
+		case "==":
+			return s == c.value
+		case "!=":
+			return s != c.value
+		}
+		return false
+	}
+
+	switch c.op {
+	case "==":
+		return a == b
+	case "!=":
+		return a != b
+	case ">=":
+		return a >= b
+	case "<=":
+		return a <= b
+	case ">":
+		return a > b
+	}
+	return a < b
+}
+
+// gate removes the metrics of any conditions which don't hold.
+func (c *config) gate(jq *jsonq.JsonQuery, b *batch) {
+	for _, cond := range c.conditions {
+		if cond.holds(jq) {
+			continue
+		}
+
+		gated := func(name string) bool {
+			return len(cond.metrics) == 0 || cond.metrics.matches(name)
+		}
+		for name := range b.Gauges {
+			if gated(name) {
+				log.Printf("  %s skipped, %s%s%s doesn't hold", name, cond.path, cond.op, cond.value)
+				delete(b.Gauges, name)
+			}
+		}
+		for name := range b.Counters {
+			if gated(name) {
+				log.Printf("  %s skipped, %s%s%s doesn't hold", name, cond.path, cond.op, cond.value)
+				delete(b.Counters, name)
+			}
+		}
+	}
+}
+
+type conditionList []condition
+
+func (l *conditionList) Set(v string) error {
+	c, err := parseCondition(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, c)
+	return nil
+}
+
+func (l *conditionList) String() string {
+	s := make([]string, len(*l))
+	for i, c := range *l {
+		s[i] = c.path + c.op + c.value
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"strings"
+)
+
+// An xmlElement is an element being decoded.
+type xmlElement struct {
+	name   string
+	fields map[string]interface{}
+	text   strings.Builder
+}
+
+// decodeXML decodes an XML document into the same kind of document JSON
+// decodes into. Each element is an object of its attributes, prefixed with @,
+// and its child elements. Repeated children become an array, and an element
+// with only text becomes its text, or a number if it looks like one. Names are
+// used without their namespaces.
+func decodeXML(r io.Reader) (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+
+	var stack []*xmlElement
+	dec := xml.NewDecoder(r)
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return doc, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			e := &xmlElement{name: tok.Name.Local, fields: make(map[string]interface{})}
+			for _, a := range tok.Attr {
+				if a.Name.Space == "xmlns" || a.Name.Local == "xmlns" {
+					continue
+				}
+				e.fields["@"+a.Name.Local] = xmlValue(a.Value)
+			}
+			stack = append(stack, e)
+		case xml.CharData:
+			if len(stack) > 0 {
+				stack[len(stack)-1].text.Write(tok)
+			}
+		case xml.EndElement:
+			e := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+
+			var v interface{} = e.fields
+			text := strings.TrimSpace(e.text.String())
+			if len(e.fields) == 0 {
+				v = xmlValue(text)
+			} else if text != "" {
+				e.fields["#text"] = xmlValue(text)
+			}
+
+			parent := doc
+			if len(stack) > 0 {
+				parent = stack[len(stack)-1].fields
+			}
+			addXMLChild(parent, e.name, v)
+		}
+	}
+}
+
+// addXMLChild adds a child element to its parent, making an array of any
+// repeated children.
+func addXMLChild(parent map[string]interface{}, name string, v interface{}) {
+	switch prev := parent[name].(type) {
+	case nil:
+		parent[name] = v
+	case []interface{}:
+		parent[name] = append(prev, v)
+	default:
+		parent[name] = []interface{}{prev, v}
+	}
+}
+
+// xmlValue returns text as a number if it's a finite decimal, since XML has no
+// types of its own.
+func xmlValue(s string) interface{} {
+	s = strings.TrimSpace(s)
+	if n, ok := decimal(s); ok {
+		return n
+	}
+	return s
+}
+
+// xmlSelectors lets metric paths be written as XML selectors, with elements
+// and @attributes separated by slashes (e.g. stats/pool/@active).
+func xmlSelectors(metrics ...[]metric) {
+	for _, l := range metrics {
+		for i, m := range l {
+			if strings.Contains(m.path, "/") {
+				l[i].segments = strings.Split(strings.Trim(m.path, "/"), "/")
+			}
+		}
+	}
+}